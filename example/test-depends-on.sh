@@ -0,0 +1,5 @@
+#!/bin/sh -e
+
+# test-depends_on-init must have run to completion before this starts
+[ -f /depends-on/initialized ] || (echo "=depends_on: FAIL"; exit 1)
+echo "=depends_on: PASS"
@@ -0,0 +1,5 @@
+#!/bin/sh -e
+
+[ -c /dev/capp-full ] || (echo "=devices: FAIL"; exit 1)
+head -c 1 /dev/capp-full > /dev/null || (echo "=devices: FAIL"; exit 1)
+echo "=devices: PASS"
@@ -0,0 +1,5 @@
+#!/bin/sh -e
+
+[ "$FROM_ENV_FILE" = "yes" ] || (echo "=env_file: FAIL"; exit 1)
+[ "$FOO" = "BAR" ] || (echo "=env_file: FAIL"; exit 1)
+echo "=env_file: PASS"
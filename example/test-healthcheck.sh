@@ -0,0 +1,4 @@
+#!/bin/sh -e
+
+# This service only gets started once test-healthcheck is healthy
+echo "=healthcheck: PASS"
@@ -0,0 +1,5 @@
+#!/bin/sh -e
+
+[ "$(tr '\0' ' ' < /proc/1/cmdline)" = "/sbin/docker-init -- /test.sh " ] || (echo "=init: FAIL"; exit 1)
+[ "$$" != "1" ] || (echo "=init: FAIL"; exit 1)
+echo "=init: PASS"
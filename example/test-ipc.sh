@@ -0,0 +1,38 @@
+#!/bin/sh -e
+
+fail() {
+	echo "=ipc $1: FAIL"
+	exit 1
+}
+
+shm=$(grep " /dev/shm " /proc/mounts || true)
+
+case $1 in
+shm_size)
+	[ "$(df -k /dev/shm | awk 'NR==2 {print $2}')" = "262144" ] || fail $1
+	;;
+host)
+	# The host's /dev/shm is bound in rather than getting a 64M tmpfs
+	[ -n "$shm" ] || fail $1
+	[ "$(df -k /dev/shm | awk 'NR==2 {print $2}')" != "65536" ] || fail $1
+	;;
+none)
+	[ -z "$shm" ] || fail $1
+	;;
+shareable)
+	[ "$(df -k /dev/shm | awk 'NR==2 {print $2}')" = "65536" ] || fail $1
+	echo shared > /dev/shm/capp-ipc-shareable
+	echo "=ipc $1: PASS"
+	# Stay up so test-ipc-service can join our ipc namespace
+	exec sleep 3600
+	;;
+service)
+	# test-ipc-shareable may still be starting up
+	for i in 1 2 3 4 5 6 7 8 9 10 ; do
+		[ -f /dev/shm/capp-ipc-shareable ] && break
+		sleep 1
+	done
+	[ "$(cat /dev/shm/capp-ipc-shareable)" = "shared" ] || fail $1
+	;;
+esac
+echo "=ipc $1: PASS"
@@ -0,0 +1,5 @@
+#!/bin/sh -e
+
+# In its own pid namespace this script would be pid 1
+[ "$$" != "1" ] || (echo "=pid: FAIL"; exit 1)
+echo "=pid: PASS"
@@ -0,0 +1,39 @@
+#!/bin/sh -e
+
+# cgroup v2 has a single unified hierarchy, v1 has one per controller
+if [ -f /sys/fs/cgroup/cgroup.controllers ]; then
+	[ "$(cat /sys/fs/cgroup/memory.max)" == "67108864" ] || (echo "=mem_limit: FAIL"; exit 1)
+	echo "=mem_limit: PASS"
+	[ "$(cat /sys/fs/cgroup/memory.low)" == "33554432" ] || (echo "=mem_reservation: FAIL"; exit 1)
+	echo "=mem_reservation: PASS"
+	# v2 only tracks the swap portion of memswap_limit
+	[ "$(cat /sys/fs/cgroup/memory.swap.max)" == "33554432" ] || (echo "=memswap_limit: FAIL"; exit 1)
+	echo "=memswap_limit: PASS"
+	[ "$(cat /sys/fs/cgroup/cpu.max)" == "50000 100000" ] || (echo "=cpu_quota/cpu_period: FAIL"; exit 1)
+	echo "=cpu_quota/cpu_period: PASS"
+	[ "$(cat /sys/fs/cgroup/cpu.weight)" != "100" ] || (echo "=cpu_shares: FAIL"; exit 1)
+	echo "=cpu_shares: PASS"
+	[ "$(cat /sys/fs/cgroup/cpuset.cpus)" == "0" ] || (echo "=cpuset: FAIL"; exit 1)
+	echo "=cpuset: PASS"
+	[ "$(cat /sys/fs/cgroup/pids.max)" == "64" ] || (echo "=pids_limit: FAIL"; exit 1)
+	echo "=pids_limit: PASS"
+else
+	[ "$(cat /sys/fs/cgroup/memory/memory.limit_in_bytes)" == "67108864" ] || (echo "=mem_limit: FAIL"; exit 1)
+	echo "=mem_limit: PASS"
+	[ "$(cat /sys/fs/cgroup/memory/memory.soft_limit_in_bytes)" == "33554432" ] || (echo "=mem_reservation: FAIL"; exit 1)
+	echo "=mem_reservation: PASS"
+	[ "$(cat /sys/fs/cgroup/memory/memory.memsw.limit_in_bytes)" == "100663296" ] || (echo "=memswap_limit: FAIL"; exit 1)
+	echo "=memswap_limit: PASS"
+	[ "$(cat /sys/fs/cgroup/memory/memory.swappiness)" == "10" ] || (echo "=mem_swappiness: FAIL"; exit 1)
+	echo "=mem_swappiness: PASS"
+	[ "$(cat /sys/fs/cgroup/cpu/cpu.cfs_quota_us)" == "50000" ] || (echo "=cpu_quota: FAIL"; exit 1)
+	echo "=cpu_quota: PASS"
+	[ "$(cat /sys/fs/cgroup/cpu/cpu.cfs_period_us)" == "100000" ] || (echo "=cpu_period: FAIL"; exit 1)
+	echo "=cpu_period: PASS"
+	[ "$(cat /sys/fs/cgroup/cpu/cpu.shares)" == "512" ] || (echo "=cpu_shares: FAIL"; exit 1)
+	echo "=cpu_shares: PASS"
+	[ "$(cat /sys/fs/cgroup/cpuset/cpuset.cpus)" == "0" ] || (echo "=cpuset: FAIL"; exit 1)
+	echo "=cpuset: PASS"
+	[ "$(cat /sys/fs/cgroup/pids/pids.max)" == "64" ] || (echo "=pids_limit: FAIL"; exit 1)
+	echo "=pids_limit: PASS"
+fi
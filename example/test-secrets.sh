@@ -0,0 +1,16 @@
+#!/bin/sh -e
+
+fail() {
+	echo "=$1: FAIL"
+	exit 1
+}
+
+[ "$(cat /run/secrets/test-secret)" = "capp-secret" ] || fail "secrets default target"
+[ "$(stat -c %a /run/secrets/test-secret)" = "444" ] || fail "secrets default mode"
+[ "$(stat -c %u:%a /run/secrets/owned-secret)" = "1000:400" ] || fail "secrets uid and mode"
+[ "$(cat /run/secrets/owned-secret)" = "capp-secret" ] || fail "secrets owned"
+echo "=secrets: PASS"
+
+[ "$(cat /etc/test-config.conf)" = "capp-config" ] || fail "configs target"
+[ "$(stat -c %u:%g:%a /etc/test-config.conf)" = "1000:1000:440" ] || fail "configs uid, gid and mode"
+echo "=configs: PASS"
@@ -0,0 +1,10 @@
+#!/bin/sh
+
+trap 'echo "=stop_signal: PASS"; exit 0' INT
+trap 'echo "=stop_signal: FAIL"; exit 1' TERM
+
+echo "=stop_signal: waiting to be stopped"
+while true ; do
+	sleep 1 &
+	wait $!
+done
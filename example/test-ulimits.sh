@@ -0,0 +1,6 @@
+#!/bin/sh -e
+
+[ "$(ulimit -n)" = "1024" ] || (echo "=ulimits nofile: FAIL"; exit 1)
+[ "$(ulimit -Hn)" = "2048" ] || (echo "=ulimits nofile: FAIL"; exit 1)
+[ "$(ulimit -p)" = "512" ] || (echo "=ulimits nproc: FAIL"; exit 1)
+echo "=ulimits: PASS"
@@ -8,3 +8,9 @@ echo "=tmpfs-vol: PASS"
 
 touch /bind-vol/test || (echo "bind-vol: FAIL"; exit 1)
 echo "=bind-vol: PASS"
+
+touch /capp-vol/test || (echo "named-vol: FAIL"; exit 1)
+echo "=named-vol: PASS"
+
+touch /anon-vol/test || (echo "anon-vol: FAIL"; exit 1)
+echo "=anon-vol: PASS"
@@ -13,14 +13,15 @@ require (
 	github.com/docker/docker v1.4.2-0.20191113042239-ea84732a7725
 	github.com/docker/docker-credential-helpers v0.6.3 // indirect
 	github.com/docker/go-metrics v0.0.1 // indirect
+	github.com/docker/go-units v0.4.0
 	github.com/docker/libtrust v0.0.0-20160708172513-aabc10ec26b7 // indirect
 	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/morikuni/aec v1.0.0 // indirect
 	github.com/opencontainers/go-digest v1.0.0-rc1
-	github.com/opencontainers/image-spec v1.0.1 // indirect
-	github.com/opencontainers/runc v1.0.0-rc90 // indirect
+	github.com/opencontainers/image-spec v1.0.1
+	github.com/opencontainers/runc v1.0.0-rc90
 	github.com/opencontainers/runtime-spec v1.0.2
-	github.com/ostreedev/ostree-go v0.0.0-20210511152353-2ca91aaf921c // indirect
+	github.com/ostreedev/ostree-go v0.0.0-20210511152353-2ca91aaf921c
 	github.com/pkg/errors v0.9.1
 	github.com/seccomp/libseccomp-golang v0.9.1
 	github.com/syndtr/gocapability v0.0.0-20200815063812-42c35b437635 // indirect
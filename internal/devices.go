@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	compose "github.com/compose-spec/compose-go/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// HostDevice is a device node a service needs from the host it runs on.
+// Device types and numbers differ between hosts, so they're left for the
+// runner to look up on the target. A directory, like /dev/snd, stands for
+// every device under it.
+type HostDevice struct {
+	Path        string `json:"path"`
+	Target      string `json:"target"`
+	Permissions string `json:"permissions"`
+}
+
+// ServiceDevices describes the host devices a service needs. The runner
+// looks each one up on the target to fill in the entries setDevices adds to
+// the service's spec. Privileged services get every device the target has.
+type ServiceDevices struct {
+	AllHostDevices bool         `json:"all_host_devices,omitempty"`
+	Devices        []HostDevice `json:"devices,omitempty"`
+}
+
+// Based on validDeviceMode from
+//  https://raw.githubusercontent.com/docker/cli/22acbbcc4b3f/cli/command/container/opts.go
+func validDeviceMode(mode string) bool {
+	var legalDeviceMode = map[rune]bool{
+		'r': true,
+		'w': true,
+		'm': true,
+	}
+	if mode == "" {
+		return false
+	}
+	for _, c := range mode {
+		if !legalDeviceMode[c] {
+			return false
+		}
+		legalDeviceMode[c] = false
+	}
+	return true
+}
+
+// Based on parseDevice from
+//  https://raw.githubusercontent.com/docker/cli/22acbbcc4b3f/cli/command/container/opts.go
+func parseDevice(device string) (src, dst, permissions string, err error) {
+	permissions = "rwm"
+	arr := strings.Split(device, ":")
+	switch len(arr) {
+	case 3:
+		permissions = arr[2]
+		fallthrough
+	case 2:
+		if validDeviceMode(arr[1]) {
+			permissions = arr[1]
+		} else {
+			dst = arr[1]
+		}
+		fallthrough
+	case 1:
+		src = arr[0]
+	default:
+		return "", "", "", fmt.Errorf("Invalid device specification: %s", device)
+	}
+	if !validDeviceMode(permissions) {
+		return "", "", "", fmt.Errorf("Invalid device permissions in: %s", device)
+	}
+	if dst == "" {
+		dst = src
+	}
+	return src, dst, permissions, nil
+}
+
+// serviceDevices parses the service's devices. Nothing is looked up on the
+// host doing the publishing as it's unlikely to have the same devices as
+// the target.
+func serviceDevices(svc compose.ServiceConfig) ([]HostDevice, error) {
+	var devs []HostDevice
+	for _, device := range svc.Devices {
+		src, dst, permissions, err := parseDevice(device)
+		if err != nil {
+			return nil, err
+		}
+		devs = append(devs, HostDevice{Path: src, Target: dst, Permissions: permissions})
+	}
+	return devs, nil
+}
+
+// deviceType is the placeholder for the type, "c" or "b", of a host device.
+// The runner substitutes it, along with the major and minor numbers of the
+// device and cgroup entries using it, once it has found the device on the
+// target. A directory's entries get replaced with one for each device in it.
+func deviceType(path string) string {
+	return fmt.Sprintf("{{device:%s:type}}", path)
+}
+
+// Based on WithDevices from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/oci_linux.go
+// Device types and numbers can only be found on the target, see deviceType.
+// The cgroup rules are left without numbers until then, which runtimes
+// reject along with the placeholder type rather than allowing every device.
+func setDevices(spec *specs.Spec, svc compose.ServiceConfig) error {
+	if svc.Privileged {
+		spec.Linux.Resources.Devices = []specs.LinuxDeviceCgroup{
+			{
+				Allow:  true,
+				Access: "rwm",
+			},
+		}
+		return nil
+	}
+
+	devs, err := serviceDevices(svc)
+	if err != nil {
+		return err
+	}
+	for _, dev := range devs {
+		spec.Linux.Devices = append(spec.Linux.Devices, specs.LinuxDevice{
+			Path: dev.Target,
+			Type: deviceType(dev.Path),
+		})
+		spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, specs.LinuxDeviceCgroup{
+			Allow:  true,
+			Type:   deviceType(dev.Path),
+			Access: dev.Permissions,
+		})
+	}
+	return nil
+}
+
+// HostDevices returns the devices each service needs from the target.
+func HostDevices(proj *compose.Project) (map[string]ServiceDevices, error) {
+	devices := make(map[string]ServiceDevices)
+	return devices, proj.WithServices(nil, func(s compose.ServiceConfig) error {
+		if s.Privileged {
+			devices[s.Name] = ServiceDevices{AllHostDevices: true}
+			return nil
+		}
+		devs, err := serviceDevices(s)
+		if err != nil {
+			return fmt.Errorf("Service(%s): %s", s.Name, err)
+		}
+		if len(devs) > 0 {
+			devices[s.Name] = ServiceDevices{Devices: devs}
+		}
+		return nil
+	})
+}
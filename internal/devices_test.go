@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"testing"
+
+	compose "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/oci"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestSetDevices(t *testing.T) {
+	tests := []struct {
+		name    string
+		svc     compose.ServiceConfig
+		devices []specs.LinuxDevice
+		rules   []specs.LinuxDeviceCgroup
+		host    ServiceDevices
+	}{
+		{
+			name:  "privileged",
+			svc:   compose.ServiceConfig{Privileged: true, Devices: []string{"/dev/ttyUSB0"}},
+			rules: []specs.LinuxDeviceCgroup{{Allow: true, Access: "rwm"}},
+			host:  ServiceDevices{AllHostDevices: true},
+		},
+		{
+			name: "path only",
+			svc:  compose.ServiceConfig{Devices: []string{"/dev/ttyUSB0"}},
+			devices: []specs.LinuxDevice{
+				{Path: "/dev/ttyUSB0", Type: "{{device:/dev/ttyUSB0:type}}"},
+			},
+			rules: []specs.LinuxDeviceCgroup{
+				{Allow: true, Type: "{{device:/dev/ttyUSB0:type}}", Access: "rwm"},
+			},
+			host: ServiceDevices{Devices: []HostDevice{
+				{Path: "/dev/ttyUSB0", Target: "/dev/ttyUSB0", Permissions: "rwm"},
+			}},
+		},
+		{
+			name: "host:container:perms",
+			svc:  compose.ServiceConfig{Devices: []string{"/dev/ttyUSB0:/dev/modem:r", "/dev/snd:rw"}},
+			devices: []specs.LinuxDevice{
+				{Path: "/dev/modem", Type: "{{device:/dev/ttyUSB0:type}}"},
+				{Path: "/dev/snd", Type: "{{device:/dev/snd:type}}"},
+			},
+			rules: []specs.LinuxDeviceCgroup{
+				{Allow: true, Type: "{{device:/dev/ttyUSB0:type}}", Access: "r"},
+				{Allow: true, Type: "{{device:/dev/snd:type}}", Access: "rw"},
+			},
+			host: ServiceDevices{Devices: []HostDevice{
+				{Path: "/dev/ttyUSB0", Target: "/dev/modem", Permissions: "r"},
+				{Path: "/dev/snd", Target: "/dev/snd", Permissions: "rw"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.svc.Name = "app"
+			spec := testSpec(t, tt.svc)
+
+			// Devices are added after the defaults, apart from privileged
+			// services which replace them.
+			defaults := oci.DefaultSpec()
+			devices := spec.Linux.Devices[len(defaults.Linux.Devices):]
+			rules := spec.Linux.Resources.Devices
+			if !tt.svc.Privileged {
+				rules = rules[len(defaults.Linux.Resources.Devices):]
+			}
+			if len(devices) == 0 {
+				devices = nil
+			}
+			if asJSON(devices) != asJSON(tt.devices) {
+				t.Errorf("devices: got %s, expected %s", asJSON(devices), asJSON(tt.devices))
+			}
+			if asJSON(rules) != asJSON(tt.rules) {
+				t.Errorf("cgroup rules: got %s, expected %s", asJSON(rules), asJSON(tt.rules))
+			}
+
+			proj := &compose.Project{Services: compose.Services{tt.svc}}
+			host, err := HostDevices(proj)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if asJSON(host["app"]) != asJSON(tt.host) {
+				t.Errorf("host devices: got %s, expected %s", asJSON(host["app"]), asJSON(tt.host))
+			}
+		})
+	}
+}
+
+func TestSetDevicesErrors(t *testing.T) {
+	for _, device := range []string{"/dev/a:/dev/b:rx", "/dev/a:/dev/b:r:w", "/dev/a:/dev/b:rr"} {
+		svc := compose.ServiceConfig{Name: "app", Devices: []string{device}}
+		if _, err := RuncSpec(svc, testImageConfig, SpecOptions{}); err == nil {
+			t.Errorf("expected device(%s) to be rejected", device)
+		}
+	}
+}
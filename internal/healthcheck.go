@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	compose "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// Defaults from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/health.go
+const (
+	defaultProbeInterval = 30 * time.Second
+	defaultProbeTimeout  = 30 * time.Second
+	defaultProbeRetries  = 3
+)
+
+// Based on the healthcheck handling of merge from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/commit.go
+// Anything the service doesn't set is inherited from the image.
+func mergeHealthcheck(svc compose.ServiceConfig, image *container.HealthConfig) *container.HealthConfig {
+	hc := &container.HealthConfig{}
+	if image != nil {
+		*hc = *image
+	}
+	if svc.HealthCheck != nil {
+		if svc.HealthCheck.Disable {
+			return nil
+		}
+		if len(svc.HealthCheck.Test) > 0 {
+			hc.Test = svc.HealthCheck.Test
+		}
+		if svc.HealthCheck.Interval != nil {
+			hc.Interval = time.Duration(*svc.HealthCheck.Interval)
+		}
+		if svc.HealthCheck.Timeout != nil {
+			hc.Timeout = time.Duration(*svc.HealthCheck.Timeout)
+		}
+		if svc.HealthCheck.StartPeriod != nil {
+			hc.StartPeriod = time.Duration(*svc.HealthCheck.StartPeriod)
+		}
+		if svc.HealthCheck.Retries != nil {
+			hc.Retries = int(*svc.HealthCheck.Retries)
+		}
+	}
+	if len(hc.Test) == 0 || hc.Test[0] == "NONE" {
+		return nil
+	}
+	return hc
+}
+
+// Based on the healthcheck checks of verifyContainerSettings from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/container.go
+// Unset values are filled in with docker's defaults so the runner doesn't
+// need to know them.
+func validateHealthcheck(hc *container.HealthConfig) error {
+	if hc.Test[0] != "CMD" && hc.Test[0] != "CMD-SHELL" {
+		return fmt.Errorf("Invalid healthcheck test: %v", hc.Test)
+	}
+	if hc.Interval != 0 && hc.Interval < container.MinimumDuration {
+		return fmt.Errorf("Interval in Healthcheck cannot be less than %s", container.MinimumDuration)
+	}
+	if hc.Timeout != 0 && hc.Timeout < container.MinimumDuration {
+		return fmt.Errorf("Timeout in Healthcheck cannot be less than %s", container.MinimumDuration)
+	}
+	if hc.Retries < 0 {
+		return fmt.Errorf("Retries in Healthcheck cannot be negative")
+	}
+	if hc.StartPeriod != 0 && hc.StartPeriod < container.MinimumDuration {
+		return fmt.Errorf("StartPeriod in Healthcheck cannot be less than %s", container.MinimumDuration)
+	}
+
+	if hc.Interval == 0 {
+		hc.Interval = defaultProbeInterval
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = defaultProbeTimeout
+	}
+	if hc.Retries == 0 {
+		hc.Retries = defaultProbeRetries
+	}
+	return nil
+}
+
+// Healthchecks returns the healthcheck of each service that has one. The
+// image's HEALTHCHECK is expected to be the same on every platform.
+func Healthchecks(proj *compose.Project, configs ServiceConfigs) (map[string]container.HealthConfig, error) {
+	healthchecks := make(map[string]container.HealthConfig)
+	for _, s := range proj.Services {
+		var merged *container.HealthConfig
+		for i, cc := range configs[s.Name] {
+			var fullconfig struct {
+				Config container.Config `json:"config"`
+			}
+			if err := json.Unmarshal(cc.Config, &fullconfig); err != nil {
+				return nil, err
+			}
+			hc := mergeHealthcheck(s, fullconfig.Config.Healthcheck)
+			if hc != nil {
+				if err := validateHealthcheck(hc); err != nil {
+					return nil, fmt.Errorf("Service(%s): %s", s.Name, err)
+				}
+			}
+			if i > 0 && !reflect.DeepEqual(hc, merged) {
+				return nil, fmt.Errorf("Service(%s) image has a different healthcheck for platform %s", s.Name, cc.Platform)
+			}
+			merged = hc
+		}
+		if merged != nil {
+			healthchecks[s.Name] = *merged
+		}
+	}
+	return healthchecks, nil
+}
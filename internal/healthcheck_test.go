@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	compose "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func healthcheckImage(platform, healthcheck string) ContainerConfig {
+	return ContainerConfig{
+		Platform: platform,
+		Config:   []byte(`{"architecture":"amd64","os":"linux","config":{"Healthcheck":` + healthcheck + `}}`),
+	}
+}
+
+func TestHealthchecks(t *testing.T) {
+	retries := uint64(5)
+	imageCheck := `{"Test":["CMD-SHELL","curl -f localhost"],"Interval":5000000000,"Retries":2}`
+	tests := []struct {
+		name     string
+		hc       *compose.HealthCheckConfig
+		images   []ContainerConfig
+		expected *container.HealthConfig
+		err      string
+	}{
+		{
+			name:   "none",
+			images: []ContainerConfig{healthcheckImage("amd64", "null")},
+		},
+		{
+			name:   "image HEALTHCHECK",
+			images: []ContainerConfig{healthcheckImage("amd64", imageCheck)},
+			expected: &container.HealthConfig{
+				Test:     []string{"CMD-SHELL", "curl -f localhost"},
+				Interval: 5 * time.Second,
+				Timeout:  defaultProbeTimeout,
+				Retries:  2,
+			},
+		},
+		{
+			name: "service healthcheck with docker's defaults",
+			hc:   &compose.HealthCheckConfig{Test: compose.HealthCheckTest{"CMD", "true"}},
+			images: []ContainerConfig{
+				healthcheckImage("amd64", "null"),
+			},
+			expected: &container.HealthConfig{
+				Test:     []string{"CMD", "true"},
+				Interval: defaultProbeInterval,
+				Timeout:  defaultProbeTimeout,
+				Retries:  defaultProbeRetries,
+			},
+		},
+		{
+			name: "merged with image HEALTHCHECK",
+			hc: &compose.HealthCheckConfig{
+				Timeout:     durationp(3 * time.Second),
+				StartPeriod: durationp(time.Minute),
+				Retries:     &retries,
+			},
+			images: []ContainerConfig{healthcheckImage("amd64", imageCheck)},
+			expected: &container.HealthConfig{
+				Test:        []string{"CMD-SHELL", "curl -f localhost"},
+				Interval:    5 * time.Second,
+				Timeout:     3 * time.Second,
+				StartPeriod: time.Minute,
+				Retries:     5,
+			},
+		},
+		{
+			name:   "disable: true",
+			hc:     &compose.HealthCheckConfig{Disable: true},
+			images: []ContainerConfig{healthcheckImage("amd64", imageCheck)},
+		},
+		{
+			name:   "NONE",
+			hc:     &compose.HealthCheckConfig{Test: compose.HealthCheckTest{"NONE"}},
+			images: []ContainerConfig{healthcheckImage("amd64", imageCheck)},
+		},
+		{
+			name:   "image NONE",
+			images: []ContainerConfig{healthcheckImage("amd64", `{"Test":["NONE"]}`)},
+		},
+		{
+			name: "same on every platform",
+			images: []ContainerConfig{
+				healthcheckImage("amd64", imageCheck),
+				healthcheckImage("arm64", imageCheck),
+			},
+			expected: &container.HealthConfig{
+				Test:     []string{"CMD-SHELL", "curl -f localhost"},
+				Interval: 5 * time.Second,
+				Timeout:  defaultProbeTimeout,
+				Retries:  2,
+			},
+		},
+		{
+			name: "platforms disagree",
+			images: []ContainerConfig{
+				healthcheckImage("amd64", imageCheck),
+				healthcheckImage("arm64", `{"Test":["CMD","true"]}`),
+			},
+			err: "Service(app) image has a different healthcheck for platform arm64",
+		},
+		{
+			name: "platforms disagree on having one",
+			images: []ContainerConfig{
+				healthcheckImage("amd64", "null"),
+				healthcheckImage("arm64", imageCheck),
+			},
+			err: "Service(app) image has a different healthcheck for platform arm64",
+		},
+		{
+			name: "service healthcheck overrides platform differences",
+			hc:   &compose.HealthCheckConfig{Test: compose.HealthCheckTest{"CMD", "true"}},
+			images: []ContainerConfig{
+				healthcheckImage("amd64", `{"Test":["CMD","false"]}`),
+				healthcheckImage("arm64", "null"),
+			},
+			expected: &container.HealthConfig{
+				Test:     []string{"CMD", "true"},
+				Interval: defaultProbeInterval,
+				Timeout:  defaultProbeTimeout,
+				Retries:  defaultProbeRetries,
+			},
+		},
+		{
+			name:   "invalid test",
+			hc:     &compose.HealthCheckConfig{Test: compose.HealthCheckTest{"true"}},
+			images: []ContainerConfig{healthcheckImage("amd64", "null")},
+			err:    "Service(app): Invalid healthcheck test: [true]",
+		},
+		{
+			name: "interval too short",
+			hc: &compose.HealthCheckConfig{
+				Test:     compose.HealthCheckTest{"CMD", "true"},
+				Interval: durationp(time.Microsecond),
+			},
+			images: []ContainerConfig{healthcheckImage("amd64", "null")},
+			err:    "Service(app): Interval in Healthcheck cannot be less than 1ms",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proj := &compose.Project{Services: compose.Services{{Name: "app", HealthCheck: tt.hc}}}
+			hcs, err := Healthchecks(proj, ServiceConfigs{"app": tt.images})
+			if len(tt.err) > 0 {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			hc, ok := hcs["app"]
+			if tt.expected == nil {
+				if ok {
+					t.Errorf("expected no healthcheck, got %s", asJSON(hc))
+				}
+			} else if asJSON(hc) != asJSON(tt.expected) {
+				t.Errorf("got %s, expected %s", asJSON(hc), asJSON(tt.expected))
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// ServiceInfo describes a service of a published app.
+type ServiceInfo struct {
+	Image     string   `json:"image"`
+	Platforms []string `json:"platforms"`
+}
+
+// AppInfo describes an app published by CreateApp.
+type AppInfo struct {
+	Manifest    digest.Digest          `json:"manifest"`
+	Bundle      digest.Digest          `json:"bundle"`
+	Annotations map[string]string      `json:"annotations"`
+	Compose     json.RawMessage        `json:"compose"`
+	Info        BundleInfo             `json:"info"`
+	Services    map[string]ServiceInfo `json:"services"`
+	Specs       []string               `json:"specs"`
+	Units       []string               `json:"units"`
+	OstreeShas  map[string]string      `json:"ostree_shas,omitempty"`
+}
+
+// readTgz returns the regular files in a bundle.
+func readTgz(buff []byte) (map[string][]byte, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(buff))
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[hdr.Name] = content
+	}
+	return files, nil
+}
+
+// specPlatform returns the platform a spec was created for. Images without
+// a manifest list have their spec saved as "default", in which case the
+// platform is the one the app was published for: an app can't support more
+// than one platform when one of its images only supports one.
+func specPlatform(info BundleInfo, name string) string {
+	if name == "default" && len(info.Platforms) == 1 {
+		return info.Platforms[0]
+	}
+	return name
+}
+
+// describeBundle fills in an AppInfo from the content of its bundle.
+func describeBundle(app *AppInfo, files map[string][]byte) error {
+	composeContent, ok := files["docker-compose.json"]
+	if !ok {
+		return fmt.Errorf("Bundle is missing docker-compose.json")
+	}
+	app.Compose = composeContent
+
+	if content, ok := files[".bundle.json"]; ok {
+		if err := json.Unmarshal(content, &app.Info); err != nil {
+			return fmt.Errorf("Unable to parse .bundle.json: %s", err)
+		}
+	}
+
+	var config struct {
+		Services map[string]struct {
+			Image string `json:"image"`
+		} `json:"services"`
+	}
+	if err := json.Unmarshal(composeContent, &config); err != nil {
+		return fmt.Errorf("Unable to parse docker-compose.json: %s", err)
+	}
+	app.Services = make(map[string]ServiceInfo)
+	for name, svc := range config.Services {
+		app.Services[name] = ServiceInfo{Image: svc.Image, Platforms: []string{}}
+	}
+
+	app.Specs = []string{}
+	app.Units = []string{}
+	for name, content := range files {
+		switch {
+		case strings.HasPrefix(name, ".specs/"):
+			app.Specs = append(app.Specs, name)
+			parts := strings.SplitN(strings.TrimPrefix(name, ".specs/"), "/", 2)
+			if svc, ok := app.Services[parts[0]]; ok && len(parts) == 2 {
+				svc.Platforms = append(svc.Platforms, specPlatform(app.Info, parts[1]))
+				sort.Strings(svc.Platforms)
+				app.Services[parts[0]] = svc
+			}
+		case strings.HasPrefix(name, ".systemd/"):
+			app.Units = append(app.Units, name)
+		case strings.HasPrefix(name, ".ostree/"):
+			if app.OstreeShas == nil {
+				app.OstreeShas = make(map[string]string)
+			}
+			app.OstreeShas[strings.TrimPrefix(name, ".ostree/")] = string(content)
+		}
+	}
+	sort.Strings(app.Specs)
+	sort.Strings(app.Units)
+	return nil
+}
+
+// InspectApp downloads the bundle of an app published by CreateApp and
+// describes what's in it.
+func InspectApp(ctx context.Context, store ImageStore, ref string) (*AppInfo, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := store.GetRepository(ctx, named)
+	if err != nil {
+		return nil, err
+	}
+
+	var dgst digest.Digest
+	if canonical, ok := named.(reference.Canonical); ok {
+		dgst = canonical.Digest()
+	} else {
+		tag := "latest"
+		if tagged, ok := reference.TagNameOnly(named).(reference.Tagged); ok {
+			tag = tagged.Tag()
+		}
+		desc, err := repo.Tags(ctx).Get(ctx, tag)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to find app reference(%s): %s", ref, err)
+		}
+		dgst = desc.Digest
+	}
+
+	mansvc, err := repo.Manifests(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	man, err := mansvc.Get(ctx, dgst)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find app manifest(%s): %s", ref, err)
+	}
+	mani, ok := man.(*ocischema.DeserializedManifest)
+	if !ok || len(mani.Annotations["compose-app"]) == 0 {
+		return nil, fmt.Errorf("Not a compose app: %s", ref)
+	}
+	if len(mani.Layers) != 1 {
+		return nil, fmt.Errorf("Unexpected number of layers in app manifest: %d", len(mani.Layers))
+	}
+
+	app := AppInfo{
+		Manifest:    dgst,
+		Bundle:      mani.Layers[0].Digest,
+		Annotations: mani.Annotations,
+	}
+	buff, err := repo.Blobs(ctx).Get(ctx, app.Bundle)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to download app bundle: %s", err)
+	}
+	files, err := readTgz(buff)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read app bundle: %s", err)
+	}
+	return &app, describeBundle(&app, files)
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDescribeBundlePlatforms(t *testing.T) {
+	tests := []struct {
+		name      string
+		bundle    string
+		specs     []string
+		platforms map[string][]string
+	}{
+		{
+			name:      "manifest list",
+			bundle:    `{"platforms":["amd64","arm64"]}`,
+			specs:     []string{"a/amd64", "a/arm64"},
+			platforms: map[string][]string{"a": {"amd64", "arm64"}},
+		},
+		{
+			name:      "single platform image",
+			bundle:    `{"platforms":["arm64"]}`,
+			specs:     []string{"a/arm64", "b/default"},
+			platforms: map[string][]string{"a": {"arm64"}, "b": {"arm64"}},
+		},
+		{
+			name:      "no platform in common",
+			bundle:    `{"platforms":[]}`,
+			specs:     []string{"a/amd64", "b/default"},
+			platforms: map[string][]string{"a": {"amd64"}, "b": {"default"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string][]byte{
+				"docker-compose.json": []byte(`{"services":{"a":{"image":"a"},"b":{"image":"b"}}}`),
+				".bundle.json":        []byte(tt.bundle),
+			}
+			for _, spec := range tt.specs {
+				files[".specs/"+spec] = []byte("{}")
+			}
+			var app AppInfo
+			if err := describeBundle(&app, files); err != nil {
+				t.Fatal(err)
+			}
+			for name, expected := range tt.platforms {
+				if !reflect.DeepEqual(app.Services[name].Platforms, expected) {
+					t.Errorf("%s: got %v, expected %v", name, app.Services[name].Platforms, expected)
+				}
+			}
+			// The bundle's layout is reported as is
+			if len(app.Specs) != len(tt.specs) || app.Specs[len(app.Specs)-1] != ".specs/"+tt.specs[len(tt.specs)-1] {
+				t.Errorf("unexpected specs: %v", app.Specs)
+			}
+		})
+	}
+}
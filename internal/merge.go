@@ -0,0 +1,281 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+
+	compose "github.com/compose-spec/compose-go/types"
+)
+
+// Attributes whose sequences replace, rather than add to, the ones they
+// override. Names of services, volumes, etc are given as "*".
+var mergeOverridePaths = map[string]bool{
+	"/services/*/command":          true,
+	"/services/*/entrypoint":       true,
+	"/services/*/healthcheck/test": true,
+}
+
+// Attributes that can be given as either a list of "KEY=VALUE" strings or a
+// mapping. They get merged as mappings.
+var mergeListOrDictPaths = map[string]bool{
+	"/services/*/environment": true,
+	"/services/*/labels":      true,
+	"/services/*/sysctls":     true,
+	"/services/*/build/args":  true,
+	"/volumes/*/labels":       true,
+	"/networks/*/labels":      true,
+}
+
+// Sequences whose entries are matched up by a key, like a volume's target,
+// so that an override replaces the entry rather than adding another one.
+var mergeKeyedPaths = map[string]func(interface{}) (string, bool){
+	"/services/*/volumes": volumeMergeKey,
+	"/services/*/devices": deviceMergeKey,
+	"/services/*/secrets": func(v interface{}) (string, bool) { return fileMountMergeKey("secrets", v) },
+	"/services/*/configs": func(v interface{}) (string, bool) { return fileMountMergeKey("configs", v) },
+	"/services/*/ports":   portMergeKey,
+}
+
+// Top level sections made up of named objects
+var mergeNamedSections = map[string]bool{
+	"/services": true,
+	"/volumes":  true,
+	"/networks": true,
+	"/secrets":  true,
+	"/configs":  true,
+}
+
+// MergeConfigs merges compose files in the order given, each one
+// overriding the ones before it, following the compose-spec rules:
+//  * mappings are merged
+//  * sequences are combined, apart from command, entrypoint and
+//    healthcheck tests which get replaced
+//  * volumes, devices, secrets and configs with the same target, and ports
+//    with the same published port, replace the entry they override
+//  * anything else gets replaced
+//  * null unsets the attribute, or the variable, label, etc it overrides.
+//    Empty top level sections and named entries like `data:` under volumes
+//    just declare them and leave them as they were
+// Attributes only found in one file are left untouched so that a single
+// file comes out exactly as it went in.
+func MergeConfigs(configs ...map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
+	for _, config := range configs {
+		merged = mergeMapping("", merged, config)
+	}
+	return merged
+}
+
+func mergeMapping(path string, base, override map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{})
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		baseVal, ok := merged[k]
+		if !ok || baseVal == nil {
+			merged[k] = v
+			continue
+		} else if v == nil {
+			if mergeListOrDictPaths[path] {
+				merged[k] = nil
+			} else if len(path) > 0 && !mergeNamedSections[path] {
+				delete(merged, k)
+			}
+			continue
+		}
+		childPath := path + "/" + k
+		if mergeNamedSections[path] {
+			childPath = path + "/*"
+		}
+		merged[k] = mergeValue(childPath, baseVal, v)
+	}
+	return merged
+}
+
+func mergeValue(path string, base, override interface{}) interface{} {
+	if mergeOverridePaths[path] {
+		return override
+	}
+	if mergeListOrDictPaths[path] {
+		return mergeMapping(path, listToMapping(base), listToMapping(override))
+	}
+	if path == "/services/*/depends_on" {
+		return mergeMapping(path, dependsOnToMapping(base), dependsOnToMapping(override))
+	}
+
+	baseMap, baseIsMap := base.(map[string]interface{})
+	overrideMap, overrideIsMap := override.(map[string]interface{})
+	if baseIsMap && overrideIsMap {
+		return mergeMapping(path, baseMap, overrideMap)
+	}
+
+	baseList, baseIsList := base.([]interface{})
+	overrideList, overrideIsList := override.([]interface{})
+	if baseIsList || overrideIsList {
+		// Attributes like env_file and dns can be a string or a list
+		if !baseIsList && !baseIsMap {
+			baseList = []interface{}{base}
+		}
+		if !overrideIsList && !overrideIsMap {
+			overrideList = []interface{}{override}
+		}
+		if baseList != nil && overrideList != nil {
+			if key, ok := mergeKeyedPaths[path]; ok {
+				return mergeKeyed(baseList, overrideList, key)
+			}
+			return appendUnique(baseList, overrideList)
+		}
+	}
+	return override
+}
+
+func appendUnique(base, override []interface{}) []interface{} {
+	merged := append([]interface{}{}, base...)
+	for _, item := range override {
+		found := false
+		for _, existing := range merged {
+			if reflect.DeepEqual(item, existing) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, item)
+		}
+	}
+	return merged
+}
+
+// mergeKeyed combines sequences replacing the base entries an override
+// entry shares a key with. Entries without a key are combined like any
+// other sequence.
+func mergeKeyed(base, override []interface{}, key func(interface{}) (string, bool)) []interface{} {
+	merged := append([]interface{}{}, base...)
+	for _, item := range override {
+		k, ok := key(item)
+		if !ok {
+			merged = appendUnique(merged, []interface{}{item})
+			continue
+		}
+		replaced := false
+		for i := 0; i < len(merged); i++ {
+			if existing, ok := key(merged[i]); !ok || existing != k {
+				continue
+			}
+			if replaced {
+				merged = append(merged[:i], merged[i+1:]...)
+				i--
+			} else {
+				merged[i] = item
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, item)
+		}
+	}
+	return merged
+}
+
+// volumeMergeKey returns the target of a volume given as
+// "[SOURCE:]TARGET[:MODE]" or in its long form.
+func volumeMergeKey(val interface{}) (string, bool) {
+	if mapping, ok := val.(map[string]interface{}); ok {
+		target, ok := mapping["target"].(string)
+		return path.Clean(target), ok
+	}
+	parts := strings.Split(fmt.Sprint(val), ":")
+	if len(parts) == 1 {
+		return path.Clean(parts[0]), true
+	}
+	return path.Clean(parts[1]), true
+}
+
+// deviceMergeKey returns the path in the container of a device.
+func deviceMergeKey(val interface{}) (string, bool) {
+	_, dst, _, err := parseDevice(fmt.Sprint(val))
+	return dst, err == nil
+}
+
+// fileMountMergeKey returns where a secret or config is mounted.
+func fileMountMergeKey(kind string, val interface{}) (string, bool) {
+	var ref compose.FileReferenceConfig
+	if mapping, ok := val.(map[string]interface{}); ok {
+		ref.Source, _ = mapping["source"].(string)
+		ref.Target, _ = mapping["target"].(string)
+	} else {
+		ref.Source = fmt.Sprint(val)
+	}
+	if len(ref.Source) == 0 && len(ref.Target) == 0 {
+		return "", false
+	}
+	return fileMountTarget(kind, ref), true
+}
+
+// portMergeKey returns the host ip, published port and protocol of a port
+// given as "[[IP:]PUBLISHED:]TARGET[/PROTOCOL]" or in its long form. Ports
+// that aren't published have no key.
+func portMergeKey(val interface{}) (string, bool) {
+	var ip, published, protocol string
+	if mapping, ok := val.(map[string]interface{}); ok {
+		if p, ok := mapping["published"]; ok && p != nil {
+			published = fmt.Sprint(p)
+		}
+		ip, _ = mapping["host_ip"].(string)
+		protocol, _ = mapping["protocol"].(string)
+	} else {
+		spec := fmt.Sprint(val)
+		if i := strings.LastIndex(spec, "/"); i >= 0 {
+			spec, protocol = spec[:i], spec[i+1:]
+		}
+		if i := strings.LastIndex(spec, ":"); i >= 0 {
+			published = spec[:i]
+			if j := strings.LastIndex(published, ":"); j >= 0 {
+				ip, published = published[:j], published[j+1:]
+			}
+		}
+	}
+	if len(published) == 0 {
+		return "", false
+	}
+	if len(protocol) == 0 {
+		protocol = "tcp"
+	}
+	return ip + ":" + published + "/" + protocol, true
+}
+
+// listToMapping converts the ["KEY=VALUE", "KEY"] form of an attribute
+// into its {KEY: VALUE, KEY: null} form.
+func listToMapping(val interface{}) map[string]interface{} {
+	if mapping, ok := val.(map[string]interface{}); ok {
+		return mapping
+	}
+	mapping := make(map[string]interface{})
+	list, _ := val.([]interface{})
+	for _, item := range list {
+		parts := strings.SplitN(fmt.Sprint(item), "=", 2)
+		if len(parts) == 2 {
+			mapping[parts[0]] = parts[1]
+		} else {
+			mapping[parts[0]] = nil
+		}
+	}
+	return mapping
+}
+
+// dependsOnToMapping converts the short, list, form of depends_on into its
+// long form.
+func dependsOnToMapping(val interface{}) map[string]interface{} {
+	if mapping, ok := val.(map[string]interface{}); ok {
+		return mapping
+	}
+	mapping := make(map[string]interface{})
+	list, _ := val.([]interface{})
+	for _, item := range list {
+		mapping[fmt.Sprint(item)] = map[string]interface{}{"condition": "service_started"}
+	}
+	return mapping
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeKeyedSequences(t *testing.T) {
+	tests := []struct {
+		name     string
+		attr     string
+		base     []interface{}
+		override []interface{}
+		expected []interface{}
+	}{
+		{
+			name:     "volume replaced by target",
+			attr:     "volumes",
+			base:     []interface{}{"/srv/old:/cfg", "data:/data"},
+			override: []interface{}{"/srv/new:/cfg/:ro"},
+			expected: []interface{}{"/srv/new:/cfg/:ro", "data:/data"},
+		},
+		{
+			name: "long volume replaces short one",
+			attr: "volumes",
+			base: []interface{}{"/srv/old:/cfg"},
+			override: []interface{}{
+				map[string]interface{}{"type": "bind", "source": "/srv/new", "target": "/cfg"},
+			},
+			expected: []interface{}{
+				map[string]interface{}{"type": "bind", "source": "/srv/new", "target": "/cfg"},
+			},
+		},
+		{
+			name:     "anonymous volume keyed by target",
+			attr:     "volumes",
+			base:     []interface{}{"/cache"},
+			override: []interface{}{"cache:/cache", "/tmp"},
+			expected: []interface{}{"cache:/cache", "/tmp"},
+		},
+		{
+			name:     "port replaced by published port",
+			attr:     "ports",
+			base:     []interface{}{"8080:80", "9090:90"},
+			override: []interface{}{"8080:81"},
+			expected: []interface{}{"8080:81", "9090:90"},
+		},
+		{
+			name:     "ports on other protocols and ips kept",
+			attr:     "ports",
+			base:     []interface{}{"8080:80", "127.0.0.1:53:53/udp"},
+			override: []interface{}{"8080:80/udp", "10.0.0.1:53:53/udp"},
+			expected: []interface{}{"8080:80", "127.0.0.1:53:53/udp", "8080:80/udp", "10.0.0.1:53:53/udp"},
+		},
+		{
+			name: "long port replaces short one",
+			attr: "ports",
+			base: []interface{}{"8080:80"},
+			override: []interface{}{
+				map[string]interface{}{"published": 8080, "target": 81},
+			},
+			expected: []interface{}{
+				map[string]interface{}{"published": 8080, "target": 81},
+			},
+		},
+		{
+			name:     "unpublished ports combined",
+			attr:     "ports",
+			base:     []interface{}{"80", 81},
+			override: []interface{}{"80", 82},
+			expected: []interface{}{"80", 81, 82},
+		},
+		{
+			name:     "device replaced by container path",
+			attr:     "devices",
+			base:     []interface{}{"/dev/ttyUSB0:/dev/modem"},
+			override: []interface{}{"/dev/ttyUSB1:/dev/modem:r"},
+			expected: []interface{}{"/dev/ttyUSB1:/dev/modem:r"},
+		},
+		{
+			name: "secret replaced by target",
+			attr: "secrets",
+			base: []interface{}{"token"},
+			override: []interface{}{
+				map[string]interface{}{"source": "token2", "target": "/run/secrets/token"},
+				"other",
+			},
+			expected: []interface{}{
+				map[string]interface{}{"source": "token2", "target": "/run/secrets/token"},
+				"other",
+			},
+		},
+		{
+			name:     "config replaced by target",
+			attr:     "configs",
+			base:     []interface{}{"app"},
+			override: []interface{}{map[string]interface{}{"source": "app2", "target": "/app"}},
+			expected: []interface{}{map[string]interface{}{"source": "app2", "target": "/app"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := map[string]interface{}{
+				"services": map[string]interface{}{
+					"a": map[string]interface{}{tt.attr: tt.base},
+				},
+			}
+			override := map[string]interface{}{
+				"services": map[string]interface{}{
+					"a": map[string]interface{}{tt.attr: tt.override},
+				},
+			}
+			merged := MergeConfigs(base, override)
+			svc := merged["services"].(map[string]interface{})["a"].(map[string]interface{})
+			if !reflect.DeepEqual(svc[tt.attr], tt.expected) {
+				t.Errorf("got %v, expected %v", svc[tt.attr], tt.expected)
+			}
+		})
+	}
+}
+
+func TestMergeNulls(t *testing.T) {
+	base := map[string]interface{}{
+		"services": map[string]interface{}{
+			"a": map[string]interface{}{
+				"image":       "alpine",
+				"command":     []interface{}{"sleep", "1"},
+				"environment": map[string]interface{}{"FOO": "foo", "BAR": "bar"},
+				"labels":      []interface{}{"l1=one", "l2=two"},
+			},
+		},
+		"volumes": map[string]interface{}{
+			"data": map[string]interface{}{"driver": "local"},
+		},
+		"secrets": map[string]interface{}{
+			"token": map[string]interface{}{"file": "./token.txt"},
+		},
+	}
+	override := map[string]interface{}{
+		"services": map[string]interface{}{
+			"a": map[string]interface{}{
+				"command":     nil,
+				"environment": map[string]interface{}{"FOO": nil},
+				"labels":      []interface{}{"l2"},
+			},
+		},
+		"volumes": map[string]interface{}{"data": nil},
+		"secrets": nil,
+	}
+	expected := map[string]interface{}{
+		"services": map[string]interface{}{
+			"a": map[string]interface{}{
+				"image":       "alpine",
+				"environment": map[string]interface{}{"FOO": nil, "BAR": "bar"},
+				"labels":      map[string]interface{}{"l1": "one", "l2": nil},
+			},
+		},
+		"volumes": map[string]interface{}{
+			"data": map[string]interface{}{"driver": "local"},
+		},
+		"secrets": map[string]interface{}{
+			"token": map[string]interface{}{"file": "./token.txt"},
+		},
+	}
+	merged := MergeConfigs(base, override)
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("got %v, expected %v", merged, expected)
+	}
+}
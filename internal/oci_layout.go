@@ -0,0 +1,343 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ImageStore is where service images get pinned from and apps get
+// published to.
+type ImageStore interface {
+	GetRepository(ctx context.Context, ref reference.Named) (distribution.Repository, error)
+}
+
+// NewImageStore returns an ImageStore for the OCI image layout at ociLayout
+// or, when it's empty, for the image's registry.
+func NewImageStore(ociLayout string, opts RegistryOptions) (ImageStore, error) {
+	if len(ociLayout) == 0 {
+		return NewRegistryClient(opts)
+	}
+	return NewOCILayout(ociLayout)
+}
+
+// OCILayout is an ImageStore backed by an on-disk OCI image layout:
+//  https://github.com/opencontainers/image-spec/blob/v1.0.1/image-layout.md
+// Images are found by their "org.opencontainers.image.ref.name" annotation
+// which can be either the familiar (alpine:latest) or fully qualified
+// (docker.io/library/alpine:latest) form of the image reference. Layouts
+// written by tools like skopeo and buildx only hold the tag (latest), which
+// is used when the layout has no image by either name.
+type OCILayout struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewOCILayout opens the OCI image layout at dir, creating it if needed.
+func NewOCILayout(dir string) (*OCILayout, error) {
+	layout := &OCILayout{dir: dir}
+	if _, err := os.Stat(filepath.Join(dir, v1.ImageLayoutFile)); err == nil {
+		return layout, nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "blobs", string(digest.SHA256)), 0o755); err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, v1.ImageLayoutFile), content, 0o644); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); os.IsNotExist(err) {
+		return layout, layout.writeIndex(v1.Index{Versioned: specs.Versioned{SchemaVersion: 2}})
+	}
+	return layout, nil
+}
+
+func (l *OCILayout) GetRepository(ctx context.Context, ref reference.Named) (distribution.Repository, error) {
+	return &ociRepository{layout: l, named: reference.TrimNamed(ref)}, nil
+}
+
+func (l *OCILayout) blobPath(dgst digest.Digest) string {
+	return filepath.Join(l.dir, "blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+func (l *OCILayout) readIndex() (v1.Index, error) {
+	var index v1.Index
+	content, err := ioutil.ReadFile(filepath.Join(l.dir, "index.json"))
+	if err != nil {
+		return index, err
+	}
+	if err := json.Unmarshal(content, &index); err != nil {
+		return index, fmt.Errorf("Unable to parse OCI layout index: %s", err)
+	}
+	return index, nil
+}
+
+func (l *OCILayout) writeIndex(index v1.Index) error {
+	content, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(l.dir, "index.json.tmp")
+	if err := ioutil.WriteFile(tmp, content, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(l.dir, "index.json"))
+}
+
+// refNames returns the names an image can be found under in the index.
+func refNames(named reference.Named, tag string) []string {
+	tagged, err := reference.WithTag(named, tag)
+	if err != nil {
+		return nil
+	}
+	return []string{tagged.String(), reference.FamiliarString(tagged)}
+}
+
+type ociRepository struct {
+	layout *OCILayout
+	named  reference.Named
+}
+
+func (r *ociRepository) Named() reference.Named {
+	return r.named
+}
+
+func (r *ociRepository) Manifests(ctx context.Context, options ...distribution.ManifestServiceOption) (distribution.ManifestService, error) {
+	return &ociManifests{repo: r}, nil
+}
+
+func (r *ociRepository) Blobs(ctx context.Context) distribution.BlobStore {
+	return &ociBlobs{layout: r.layout}
+}
+
+func (r *ociRepository) Tags(ctx context.Context) distribution.TagService {
+	return &ociTags{repo: r}
+}
+
+type ociBlobs struct {
+	layout *OCILayout
+}
+
+func (b *ociBlobs) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	fi, err := os.Stat(b.layout.blobPath(dgst))
+	if os.IsNotExist(err) {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	} else if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	return distribution.Descriptor{Digest: dgst, Size: fi.Size(), MediaType: "application/octet-stream"}, nil
+}
+
+func (b *ociBlobs) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	content, err := ioutil.ReadFile(b.layout.blobPath(dgst))
+	if os.IsNotExist(err) {
+		return nil, distribution.ErrBlobUnknown
+	}
+	return content, err
+}
+
+func (b *ociBlobs) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	f, err := os.Open(b.layout.blobPath(dgst))
+	if os.IsNotExist(err) {
+		return nil, distribution.ErrBlobUnknown
+	}
+	return f, err
+}
+
+func (b *ociBlobs) Put(ctx context.Context, mediaType string, p []byte) (distribution.Descriptor, error) {
+	desc := distribution.Descriptor{Digest: digest.FromBytes(p), Size: int64(len(p)), MediaType: mediaType}
+	path := b.layout.blobPath(desc.Digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return desc, err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, p, 0o644); err != nil {
+		return desc, err
+	}
+	return desc, os.Rename(tmp, path)
+}
+
+func (b *ociBlobs) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	return nil, distribution.ErrUnsupported
+}
+
+func (b *ociBlobs) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
+	return nil, distribution.ErrUnsupported
+}
+
+func (b *ociBlobs) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
+	return distribution.ErrUnsupported
+}
+
+func (b *ociBlobs) Delete(ctx context.Context, dgst digest.Digest) error {
+	return distribution.ErrUnsupported
+}
+
+type ociManifests struct {
+	repo *ociRepository
+}
+
+func (m *ociManifests) Exists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	_, err := os.Stat(m.repo.layout.blobPath(dgst))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// manifestMediaType finds the media type of a manifest. The mediaType field
+// is optional for OCI manifests and indexes, so fall back to looking at
+// what the manifest contains.
+func manifestMediaType(content []byte) (string, error) {
+	var man struct {
+		MediaType string            `json:"mediaType"`
+		Manifests []json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(content, &man); err != nil {
+		return "", err
+	}
+	if len(man.MediaType) > 0 {
+		return man.MediaType, nil
+	}
+	if man.Manifests != nil {
+		return v1.MediaTypeImageIndex, nil
+	}
+	return v1.MediaTypeImageManifest, nil
+}
+
+func (m *ociManifests) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	content, err := ioutil.ReadFile(m.repo.layout.blobPath(dgst))
+	if os.IsNotExist(err) {
+		return nil, distribution.ErrManifestUnknownRevision{Name: m.repo.named.Name(), Revision: dgst}
+	} else if err != nil {
+		return nil, err
+	}
+	mediaType, err := manifestMediaType(content)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse manifest %s: %s", dgst, err)
+	}
+	man, _, err := distribution.UnmarshalManifest(mediaType, content)
+	return man, err
+}
+
+func (m *ociManifests) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	mediaType, payload, err := manifest.Payload()
+	if err != nil {
+		return "", err
+	}
+	desc, err := m.repo.Blobs(ctx).Put(ctx, mediaType, payload)
+	if err != nil {
+		return "", err
+	}
+	for _, option := range options {
+		if opt, ok := option.(distribution.WithTagOption); ok {
+			if err := m.repo.Tags(ctx).Tag(ctx, opt.Tag, desc); err != nil {
+				return "", err
+			}
+		}
+	}
+	return desc.Digest, nil
+}
+
+func (m *ociManifests) Delete(ctx context.Context, dgst digest.Digest) error {
+	return distribution.ErrUnsupported
+}
+
+type ociTags struct {
+	repo *ociRepository
+}
+
+func (t *ociTags) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
+	t.repo.layout.mu.Lock()
+	defer t.repo.layout.mu.Unlock()
+
+	index, err := t.repo.layout.readIndex()
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	names := refNames(t.repo.named, tag)
+	var tagged []v1.Descriptor
+	for _, desc := range index.Manifests {
+		name := desc.Annotations[v1.AnnotationRefName]
+		for _, n := range names {
+			if name == n {
+				return ociDescriptor(desc), nil
+			}
+		}
+		if name == tag {
+			tagged = append(tagged, desc)
+		}
+	}
+	if len(tagged) > 1 {
+		return distribution.Descriptor{}, fmt.Errorf("OCI layout has more than one image tagged %s, unable to tell which one is %s", tag, t.repo.named.Name())
+	} else if len(tagged) == 1 {
+		return ociDescriptor(tagged[0]), nil
+	}
+	return distribution.Descriptor{}, distribution.ErrTagUnknown{Tag: tag}
+}
+
+func ociDescriptor(desc v1.Descriptor) distribution.Descriptor {
+	return distribution.Descriptor{
+		MediaType: desc.MediaType,
+		Digest:    desc.Digest,
+		Size:      desc.Size,
+	}
+}
+
+func (t *ociTags) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
+	t.repo.layout.mu.Lock()
+	defer t.repo.layout.mu.Unlock()
+
+	index, err := t.repo.layout.readIndex()
+	if err != nil {
+		return err
+	}
+	names := refNames(t.repo.named, tag)
+	if len(names) == 0 {
+		return fmt.Errorf("Invalid tag: %s", tag)
+	}
+
+	// Replace any existing entry for the tag. Entries with only the tag may
+	// belong to another image so they're left alone.
+	manifests := index.Manifests[:0]
+	for _, d := range index.Manifests {
+		name := d.Annotations[v1.AnnotationRefName]
+		if name != names[0] && name != names[1] {
+			manifests = append(manifests, d)
+		}
+	}
+	index.Manifests = append(manifests, v1.Descriptor{
+		MediaType:   desc.MediaType,
+		Digest:      desc.Digest,
+		Size:        desc.Size,
+		Annotations: map[string]string{v1.AnnotationRefName: names[0]},
+	})
+	return t.repo.layout.writeIndex(index)
+}
+
+func (t *ociTags) Untag(ctx context.Context, tag string) error {
+	return distribution.ErrUnsupported
+}
+
+func (t *ociTags) All(ctx context.Context) ([]string, error) {
+	return nil, distribution.ErrUnsupported
+}
+
+func (t *ociTags) Lookup(ctx context.Context, digest distribution.Descriptor) ([]string, error) {
+	return nil, distribution.ErrUnsupported
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testLayout creates an OCI layout holding a manifest for each ref name.
+func testLayout(t *testing.T, refNames ...string) (*OCILayout, map[string]digest.Digest) {
+	t.Helper()
+	ctx := context.Background()
+	layout, err := NewOCILayout(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := layout.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := &ociBlobs{layout: layout}
+	digests := make(map[string]digest.Digest)
+	for _, name := range refNames {
+		// Give each manifest its own digest
+		content := []byte(`{"schemaVersion":2,"mediaType":"` + v1.MediaTypeImageManifest + `","annotations":{"name":"` + name + `"}}`)
+		desc, err := blobs.Put(ctx, v1.MediaTypeImageManifest, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index.Manifests = append(index.Manifests, v1.Descriptor{
+			MediaType:   desc.MediaType,
+			Digest:      desc.Digest,
+			Size:        desc.Size,
+			Annotations: map[string]string{v1.AnnotationRefName: name},
+		})
+		digests[name] = desc.Digest
+	}
+	if err := layout.writeIndex(index); err != nil {
+		t.Fatal(err)
+	}
+	return layout, digests
+}
+
+func TestOCILayoutTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		refNames []string
+		ref      string
+		found    string
+		err      bool
+	}{
+		{
+			name:     "familiar name",
+			refNames: []string{"alpine:latest"},
+			ref:      "alpine:latest",
+			found:    "alpine:latest",
+		},
+		{
+			name:     "fully qualified name",
+			refNames: []string{"docker.io/library/alpine:latest"},
+			ref:      "alpine",
+			found:    "docker.io/library/alpine:latest",
+		},
+		{
+			name:     "bare tag",
+			refNames: []string{"3.12"},
+			ref:      "alpine:3.12",
+			found:    "3.12",
+		},
+		{
+			name:     "name preferred to bare tag",
+			refNames: []string{"latest", "alpine:latest"},
+			ref:      "alpine:latest",
+			found:    "alpine:latest",
+		},
+		{
+			name:     "ambiguous bare tag",
+			refNames: []string{"latest", "latest"},
+			ref:      "alpine:latest",
+			err:      true,
+		},
+		{
+			name:     "other image",
+			refNames: []string{"busybox:latest"},
+			ref:      "alpine:latest",
+			err:      true,
+		},
+		{
+			name:     "other tag",
+			refNames: []string{"alpine:3.12", "3.12"},
+			ref:      "alpine:latest",
+			err:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			layout, digests := testLayout(t, tt.refNames...)
+			named, err := reference.ParseNormalizedNamed(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo, err := layout.GetRepository(ctx, named)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tag := reference.TagNameOnly(named).(reference.Tagged).Tag()
+			desc, err := repo.Tags(ctx).Get(ctx, tag)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected %s not to be found, got %s", tt.ref, desc.Digest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if desc.Digest != digests[tt.found] {
+				t.Errorf("got %s, expected %s", desc.Digest, digests[tt.found])
+			}
+
+			mansvc, err := repo.Manifests(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			man, err := mansvc.Get(ctx, desc.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := man.(*ocischema.DeserializedManifest); !ok {
+				t.Errorf("unexpected manifest: %T", man)
+			}
+		})
+	}
+}
+
+func TestOCILayoutTagKeepsBareTags(t *testing.T) {
+	ctx := context.Background()
+	layout, digests := testLayout(t, "latest", "app:latest")
+	named, _ := reference.ParseNormalizedNamed("app")
+	repo, _ := layout.GetRepository(ctx, named)
+
+	desc, err := (&ociBlobs{layout: layout}).Put(ctx, v1.MediaTypeImageManifest, []byte(`{"schemaVersion":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Tags(ctx).Tag(ctx, "latest", desc); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := layout.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]digest.Digest)
+	for _, d := range index.Manifests {
+		found[d.Annotations[v1.AnnotationRefName]] = d.Digest
+	}
+	if len(index.Manifests) != 2 || found["latest"] != digests["latest"] || found["docker.io/library/app:latest"] != desc.Digest {
+		t.Errorf("unexpected index: %v", found)
+	}
+}
@@ -7,22 +7,19 @@ import (
 	"os"
 
 	compose "github.com/compose-spec/compose-go/types"
-	"github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/pkg/archive"
 	ostree "github.com/ostreedev/ostree-go/pkg/otbuiltin"
 )
 
-func extractImage(ctx context.Context, image string, destDir string) error {
-	regc := NewRegistryClient()
-
+func extractImage(ctx context.Context, store ImageStore, image string, destDir string) error {
 	fmt.Printf("Extracting %s -> %s\n", image, destDir)
 	named, err := reference.ParseNormalizedNamed(image)
 	if err != nil {
 		return err
 	}
 
-	repo, err := regc.GetRepository(ctx, named)
+	repo, err := store.GetRepository(ctx, named)
 	if err != nil {
 		return err
 	}
@@ -37,30 +34,29 @@ func extractImage(ctx context.Context, image string, destDir string) error {
 		return fmt.Errorf("Unable to get image manifests(%s): %s", image, err)
 	}
 
+	_, layers, err := imageManifest(man)
+	if err != nil {
+		return err
+	}
+
 	blobStore := repo.Blobs(ctx)
-	switch m := man.(type) {
-	case *schema2.DeserializedManifest:
-		for i, l := range m.Layers {
-			fmt.Printf("  | Layer %d of %d: %d bytes\n", i+1, len(m.Layers), l.Size)
-			f, err := blobStore.Open(ctx, l.Digest)
-			if err != nil {
-				return fmt.Errorf("Unable to open blob %s: %s", l.Digest, err)
-			}
-			df, err := archive.DecompressStream(f)
-			if err != nil {
-				return err
-			}
-			err = archive.Unpack(df, destDir, &archive.TarOptions{})
-			f.Close()
-			if err != nil {
-				return err
-			}
+	for i, l := range layers {
+		fmt.Printf("  | Layer %d of %d: %d bytes\n", i+1, len(layers), l.Size)
+		f, err := blobStore.Open(ctx, l.Digest)
+		if err != nil {
+			return fmt.Errorf("Unable to open blob %s: %s", l.Digest, err)
+		}
+		df, err := archive.DecompressStream(f)
+		if err != nil {
+			return err
+		}
+		err = archive.Unpack(df, destDir, &archive.TarOptions{})
+		f.Close()
+		if err != nil {
+			return err
 		}
-		fmt.Println("  |-> ")
-		break
-	default:
-		return fmt.Errorf("Unexpected manifest: %v", man)
 	}
+	fmt.Println("  |-> ")
 	return nil
 }
 
@@ -90,7 +86,7 @@ func ostreeCommit(path, repoDir, subject, branch string) (string, error) {
 	return ret, nil
 }
 
-func OstreeCommit(ctx context.Context, ostreeRepo string, proj *compose.Project, configs ServiceConfigs) (map[string][]byte, error) {
+func OstreeCommit(ctx context.Context, store ImageStore, ostreeRepo string, proj *compose.Project, configs ServiceConfigs) (map[string][]byte, error) {
 	hashes := make(map[string][]byte)
 	return hashes, proj.WithServices(nil, func(s compose.ServiceConfig) error {
 		for _, containerConfig := range configs[s.Name] {
@@ -112,7 +108,7 @@ func OstreeCommit(ctx context.Context, ostreeRepo string, proj *compose.Project,
 			}
 			defer os.RemoveAll(dir)
 
-			if err := extractImage(ctx, pinned, dir); err != nil {
+			if err := extractImage(ctx, store, pinned, dir); err != nil {
 				return err
 			}
 
@@ -6,12 +6,18 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	compose "github.com/compose-spec/compose-go/types"
 	"github.com/docker/distribution"
@@ -19,17 +25,120 @@ import (
 	"github.com/docker/distribution/manifest/ocischema"
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/builder/dockerignore"
+	"github.com/docker/docker/pkg/archive"
 	"github.com/opencontainers/go-digest"
 )
 
+// imageManifest returns the config and layers of a docker or OCI image
+// manifest.
+func imageManifest(man distribution.Manifest) (distribution.Descriptor, []distribution.Descriptor, error) {
+	switch m := man.(type) {
+	case *schema2.DeserializedManifest:
+		return m.Config, m.Layers, nil
+	case *ocischema.DeserializedManifest:
+		return m.Config, m.Layers, nil
+	}
+	return distribution.Descriptor{}, nil, fmt.Errorf("Unexpected manifest: %v", man)
+}
+
 func getContainerConfig(mansvc distribution.ManifestService, blobStore distribution.BlobStore, ctx context.Context, configDigest digest.Digest) ([]byte, error) {
 	mm, e := mansvc.Get(ctx, configDigest)
 	if e != nil {
 		return nil, e
 	}
-	dgst := mm.(*schema2.DeserializedManifest).Manifest.Config.Digest
-	return blobStore.Get(ctx, dgst)
+	config, _, e := imageManifest(mm)
+	if e != nil {
+		return nil, e
+	}
+	return blobStore.Get(ctx, config.Digest)
+}
+
+// getImageFiles returns the content of the given paths as they appear in the
+// image's final root filesystem. Layers are searched from the top down so
+// that only as many layers as needed get downloaded. Paths that don't exist
+// in the image are left out of the result.
+func getImageFiles(ctx context.Context, mansvc distribution.ManifestService, blobStore distribution.BlobStore, manifestDigest digest.Digest, paths ...string) (map[string][]byte, error) {
+	mm, err := mansvc.Get(ctx, manifestDigest)
+	if err != nil {
+		return nil, err
+	}
+	_, layers, err := imageManifest(mm)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(map[string]bool)
+	for _, p := range paths {
+		pending[p] = true
+	}
+	files := make(map[string][]byte)
+	for i := len(layers) - 1; i >= 0 && len(pending) > 0; i-- {
+		if err := scanLayer(ctx, blobStore, layers[i].Digest, pending, files); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// scanLayer reads the pending paths out of a layer. Paths the layer provides
+// or removes via whiteouts are taken out of pending so lower layers aren't
+// consulted for them.
+func scanLayer(ctx context.Context, blobStore distribution.BlobStore, layer digest.Digest, pending map[string]bool, files map[string][]byte) error {
+	f, err := blobStore.Open(ctx, layer)
+	if err != nil {
+		return fmt.Errorf("Unable to open blob %s: %s", layer, err)
+	}
+	defer f.Close()
+	df, err := archive.DecompressStream(f)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+
+	// A layer can remove a path and add it back, so whiteouts are only
+	// applied once the whole layer has been read.
+	var removed []string
+	tr := tar.NewReader(df)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to read layer %s: %s", layer, err)
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		dir, base := path.Split(name)
+		if base == archive.WhiteoutOpaqueDir {
+			for p := range pending {
+				if strings.HasPrefix(p, dir) {
+					removed = append(removed, p)
+				}
+			}
+		} else if strings.HasPrefix(base, archive.WhiteoutPrefix) {
+			target := dir + strings.TrimPrefix(base, archive.WhiteoutPrefix)
+			for p := range pending {
+				if p == target || strings.HasPrefix(p, target+"/") {
+					removed = append(removed, p)
+				}
+			}
+		} else if pending[name] {
+			if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+				content, err := ioutil.ReadAll(tr)
+				if err != nil {
+					return fmt.Errorf("Unable to read %s from layer %s: %s", name, layer, err)
+				}
+				files[name] = content
+			}
+			delete(pending, name)
+		}
+	}
+	for _, p := range removed {
+		delete(pending, p)
+	}
+	return nil
 }
 
 func iterateServices(services map[string]interface{}, proj *compose.Project, fn compose.ServiceFunc) error {
@@ -51,95 +160,396 @@ type ContainerConfig struct {
 	Platform string
 	Digest   digest.Digest
 	Config   []byte
+
+	// The image's /etc/passwd and /etc/group. These are only pulled in
+	// when the container runs as a user other than root.
+	Passwd []byte
+	Group  []byte
 }
 type ServiceConfigs map[string][]ContainerConfig
 
-func PinServiceImages(ctx context.Context, services map[string]interface{}, proj *compose.Project) (ServiceConfigs, error) {
-	regc := NewRegistryClient()
-
-	configs := make(ServiceConfigs)
+// userDbs caches the user and group databases read from each image so the
+// layers of an image shared by several services are only scanned once.
+type userDbs struct {
+	mu  sync.Mutex
+	dbs map[digest.Digest]*userDb
+}
 
-	return configs, iterateServices(services, proj, func(s compose.ServiceConfig) error {
-		name := s.Name
-		obj := services[name]
-		svc, ok := obj.(map[string]interface{})
+type userDb struct {
+	once   sync.Once
+	passwd []byte
+	group  []byte
+	err    error
+}
 
-		image := s.Image
-		if len(image) == 0 {
-			return fmt.Errorf("Service(%s) missing 'image' attribute", name)
-		}
+func (u *userDbs) get(ctx context.Context, mansvc distribution.ManifestService, blobStore distribution.BlobStore, dgst digest.Digest) (*userDb, error) {
+	u.mu.Lock()
+	db, ok := u.dbs[dgst]
+	if !ok {
+		db = &userDb{}
+		u.dbs[dgst] = db
+	}
+	u.mu.Unlock()
 
-		fmt.Printf("Pinning %s(%s)\n", name, image)
-		named, err := reference.ParseNormalizedNamed(image)
+	db.once.Do(func() {
+		files, err := getImageFiles(ctx, mansvc, blobStore, dgst, "etc/passwd", "etc/group")
 		if err != nil {
-			return err
+			db.err = fmt.Errorf("Unable to read user database: %s", err)
+			return
 		}
+		db.passwd = files["etc/passwd"]
+		db.group = files["etc/group"]
+	})
+	return db, db.err
+}
 
-		repo, err := regc.GetRepository(ctx, named)
-		if err != nil {
-			return err
+// setUserDb pulls in the image's user and group databases when the service
+// or image specifies a user so that RuncSpec can resolve it.
+func setUserDb(ctx context.Context, dbs *userDbs, mansvc distribution.ManifestService, blobStore distribution.BlobStore, s compose.ServiceConfig, cc *ContainerConfig) error {
+	var fullconfig struct {
+		Config container.Config `json:"config"`
+	}
+	if err := json.Unmarshal(cc.Config, &fullconfig); err != nil {
+		return err
+	}
+	if len(s.User) == 0 && len(fullconfig.Config.User) == 0 {
+		return nil
+	}
+	db, err := dbs.get(ctx, mansvc, blobStore, cc.Digest)
+	if err != nil {
+		return err
+	}
+	cc.Passwd = db.passwd
+	cc.Group = db.group
+	return nil
+}
+
+// BundleInfo holds the app level details the runner needs that aren't
+// specific to any one service.
+type BundleInfo struct {
+	Platforms    []string                          `json:"platforms"`
+	Devices      map[string]ServiceDevices         `json:"devices,omitempty"`
+	Healthchecks map[string]container.HealthConfig `json:"healthchecks,omitempty"`
+	// Init is the host path of the init binary the runner must provide for
+	// services with `init: true`.
+	Init string `json:"init,omitempty"`
+	// Volumes the runner must create, keyed by the name used in the
+	// {{volume:<name>}} placeholders of the specs.
+	Volumes map[string]Volume `json:"volumes,omitempty"`
+	// Secrets the runner must provide for each service.
+	Secrets map[string][]FileMount `json:"secrets,omitempty"`
+	// Variables interpolated into the compose file. Only recorded on request
+	// as they may hold secrets.
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+func platformName(arch, variant string) string {
+	if arch == "arm" {
+		return arch + variant
+	}
+	return arch
+}
+
+// configPlatform finds the platform of an image that wasn't published with
+// a manifest list by looking at its container config.
+func configPlatform(config []byte) (string, error) {
+	var cfg struct {
+		Architecture string `json:"architecture"`
+		Variant      string `json:"variant"`
+	}
+	if err := json.Unmarshal(config, &cfg); err != nil {
+		return "", err
+	}
+	return platformName(cfg.Architecture, cfg.Variant), nil
+}
+
+// intersectPlatforms returns the sorted list of platforms supported by
+// every service.
+func intersectPlatforms(svcPlatforms map[string][]string) []string {
+	counts := make(map[string]int)
+	for _, platforms := range svcPlatforms {
+		for _, plat := range platforms {
+			counts[plat]++
 		}
-		namedTagged, ok := named.(reference.Tagged)
-		if !ok {
-			return fmt.Errorf("Invalid image reference(%s): Images must be tagged. e.g %s:stable", image, image)
+	}
+	var platforms []string
+	for plat, count := range counts {
+		if count == len(svcPlatforms) {
+			platforms = append(platforms, plat)
 		}
-		tag := namedTagged.Tag()
-		desc, err := repo.Tags(ctx).Get(ctx, tag)
+	}
+	sort.Strings(platforms)
+	return platforms
+}
+
+// pinWorkers bounds the number of concurrent registry requests made while
+// pinning images.
+const pinWorkers = 8
+
+// parallel calls fn for each index from 0 to n-1 using up to pinWorkers
+// goroutines and waits for them to finish.
+func parallel(n int, fn func(i int)) {
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < pinWorkers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+}
+
+// pinnedImage is an image reference resolved to a digest along with the
+// container config of each platform it was published for.
+type pinnedImage struct {
+	image     string
+	pinned    string
+	list      bool
+	platforms []string
+	configs   []ContainerConfig
+	mansvc    distribution.ManifestService
+	blobStore distribution.BlobStore
+	// warning is set when the tag of a tag@digest reference has moved on
+	// or can't be checked
+	warning string
+	err     error
+}
+
+// resolveImage looks up the manifest an image reference points at.
+func resolveImage(ctx context.Context, store ImageStore, img *pinnedImage) error {
+	image := img.image
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return err
+	}
+
+	repo, err := store.GetRepository(ctx, named)
+	if err != nil {
+		return err
+	}
+	// A digest is used as is, the manifest fetched below proves it exists.
+	// The tag of a tag@digest reference is only checked for drift.
+	var dgst digest.Digest
+	namedTagged, tagged := named.(reference.Tagged)
+	if digested, ok := named.(reference.Digested); ok {
+		dgst = digested.Digest()
+		if tagged {
+			tag := reference.FamiliarName(named) + ":" + namedTagged.Tag()
+			desc, err := repo.Tags(ctx).Get(ctx, namedTagged.Tag())
+			if err != nil {
+				img.warning = fmt.Sprintf("Unable to check %s: %s", tag, err)
+			} else if desc.Digest != dgst {
+				img.warning = fmt.Sprintf("%s now points to %s rather than %s", tag, desc.Digest, dgst)
+			}
+		}
+	} else if tagged {
+		desc, err := repo.Tags(ctx).Get(ctx, namedTagged.Tag())
 		if err != nil {
 			return fmt.Errorf("Unable to find image reference(%s): %s", image, err)
 		}
-		mansvc, err := repo.Manifests(ctx, nil)
-		if err != nil {
-			return fmt.Errorf("Unable to get image manifests(%s): %s", image, err)
+		dgst = desc.Digest
+	} else {
+		return fmt.Errorf("Invalid image reference(%s): Images must be tagged or pinned to a digest. e.g %s:stable", image, image)
+	}
+	mansvc, err := repo.Manifests(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to get image manifests(%s): %s", image, err)
+	}
+	man, err := mansvc.Get(ctx, dgst)
+	if err != nil {
+		return fmt.Errorf("Unable to find image manifest(%s): %s", image, err)
+	}
+
+	img.mansvc = mansvc
+	img.blobStore = repo.Blobs(ctx)
+	img.pinned = reference.Domain(named) + "/" + reference.Path(named) + "@" + dgst.String()
+
+	switch mani := man.(type) {
+	case *manifestlist.DeserializedManifestList:
+		img.list = true
+		for _, m := range mani.Manifests {
+			plat := platformName(m.Platform.Architecture, m.Platform.Variant)
+			img.platforms = append(img.platforms, plat)
+			img.configs = append(img.configs, ContainerConfig{Platform: plat, Digest: m.Digest})
 		}
-		man, err := mansvc.Get(ctx, desc.Digest)
+	case *schema2.DeserializedManifest, *ocischema.DeserializedManifest:
+		img.platforms = []string{""}
+		img.configs = []ContainerConfig{{Digest: dgst}}
+	default:
+		return fmt.Errorf("Unexpected manifest: %v", mani)
+	}
+	return nil
+}
+
+// fetchConfig pulls in the container config of one of the image's platforms.
+func fetchConfig(ctx context.Context, img *pinnedImage, i int) error {
+	cfg, err := getContainerConfig(img.mansvc, img.blobStore, ctx, img.configs[i].Digest)
+	if img.list {
 		if err != nil {
-			return fmt.Errorf("Unable to find image manifest(%s): %s", image, err)
+			return fmt.Errorf("Unable to container config for %s: %v", img.platforms[i], err)
 		}
+		img.configs[i].Config = cfg
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to container config: %v", err)
+	}
+	plat, err := configPlatform(cfg)
+	if err != nil {
+		return fmt.Errorf("Unable to parse container config: %v", err)
+	}
+	img.platforms[i] = plat
+	img.configs[i].Config = cfg
+	return nil
+}
 
-		blobStore := repo.Blobs(ctx)
+// PinServiceImages resolves each service's image to a digest and returns the
+// container configs for every platform along with the platforms the app as a
+// whole can run on. An app with no platform in common is an error unless
+// warnPlatforms is set.
+//
+// Images are resolved concurrently and only once no matter how many services
+// use them. Progress is still reported one service at a time in order.
+func PinServiceImages(ctx context.Context, store ImageStore, services map[string]interface{}, proj *compose.Project, warnPlatforms bool) (ServiceConfigs, []string, error) {
+	type servicePin struct {
+		s       compose.ServiceConfig
+		img     *pinnedImage
+		configs []ContainerConfig
+		err     error
+	}
+	var pins []*servicePin
+	var images []*pinnedImage
+	byRef := make(map[string]*pinnedImage)
 
-		// TODO - we should find the intersection of platforms so
-		// that we can denote the platforms this app can run on
-		pinned := reference.Domain(named) + "/" + reference.Path(named) + "@" + desc.Digest.String()
+	err := iterateServices(services, proj, func(s compose.ServiceConfig) error {
+		if len(s.Image) == 0 {
+			return fmt.Errorf("Service(%s) missing 'image' attribute", s.Name)
+		}
+		img, ok := byRef[s.Image]
+		if !ok {
+			img = &pinnedImage{image: s.Image}
+			byRef[s.Image] = img
+			images = append(images, img)
+		}
+		pins = append(pins, &servicePin{s: s, img: img})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 
-		switch mani := man.(type) {
-		case *manifestlist.DeserializedManifestList:
-			containerConfigs := make([]ContainerConfig, len(mani.Manifests))
-			fmt.Printf("  | ")
-			for i, m := range mani.Manifests {
-				if i != 0 {
-					fmt.Printf(", ")
-				}
-				plat := m.Platform.Architecture
-				if m.Platform.Architecture == "arm" {
-					plat += m.Platform.Variant
-				}
-				fmt.Printf(plat)
-				cfg, e := getContainerConfig(mansvc, blobStore, ctx, m.Descriptor.Digest)
-				if e != nil {
-					return fmt.Errorf("Unable to container config for %s: %v", plat, e)
-				}
-				containerConfigs[i] = ContainerConfig{Platform: plat, Config: cfg, Digest: m.Digest}
-			}
-			configs[name] = containerConfigs
-		case *schema2.DeserializedManifest:
-			cfg, e := getContainerConfig(mansvc, blobStore, ctx, desc.Digest)
-			if e != nil {
-				return fmt.Errorf("Unable to container config: %v", e)
-			}
-			configs[name] = []ContainerConfig{
-				{Config: cfg, Digest: desc.Digest},
-			}
-			break
-		default:
-			return fmt.Errorf("Unexpected manifest: %v", mani)
+	// Failures are recorded with the image rather than returned so they're
+	// reported against the first service using it.
+	parallel(len(images), func(i int) {
+		images[i].err = resolveImage(ctx, store, images[i])
+	})
+
+	type configRef struct {
+		img *pinnedImage
+		idx int
+	}
+	var fetches []configRef
+	for _, img := range images {
+		if img.err != nil {
+			continue
 		}
+		for i := range img.configs {
+			fetches = append(fetches, configRef{img, i})
+		}
+	}
+	fetchErrs := make([]error, len(fetches))
+	parallel(len(fetches), func(i int) {
+		fetchErrs[i] = fetchConfig(ctx, fetches[i].img, fetches[i].idx)
+	})
+	for i, err := range fetchErrs {
+		if err != nil && fetches[i].img.err == nil {
+			fetches[i].img.err = err
+		}
+	}
 
-		fmt.Println("\n  |-> ", pinned)
-		svc["image"] = pinned
-		return nil
+	type userRef struct {
+		pin *servicePin
+		idx int
+	}
+	var users []userRef
+	for _, pin := range pins {
+		if pin.img.err != nil {
+			continue
+		}
+		pin.configs = make([]ContainerConfig, len(pin.img.configs))
+		copy(pin.configs, pin.img.configs)
+		for i := range pin.configs {
+			users = append(users, userRef{pin, i})
+		}
+	}
+	dbs := &userDbs{dbs: make(map[digest.Digest]*userDb)}
+	userErrs := make([]error, len(users))
+	parallel(len(users), func(i int) {
+		pin := users[i].pin
+		idx := users[i].idx
+		if err := setUserDb(ctx, dbs, pin.img.mansvc, pin.img.blobStore, pin.s, &pin.configs[idx]); err != nil {
+			if pin.img.list {
+				userErrs[i] = fmt.Errorf("Service(%s) on %s: %v", pin.s.Name, pin.img.platforms[idx], err)
+			} else {
+				userErrs[i] = fmt.Errorf("Service(%s): %v", pin.s.Name, err)
+			}
+		}
 	})
+	for i, err := range userErrs {
+		if err != nil && users[i].pin.err == nil {
+			users[i].pin.err = err
+		}
+	}
+
+	configs := make(ServiceConfigs)
+	svcPlatforms := make(map[string][]string)
+	for _, pin := range pins {
+		name := pin.s.Name
+		fmt.Printf("Pinning %s(%s)\n", name, pin.s.Image)
+		if pin.img.err != nil {
+			return nil, nil, pin.img.err
+		}
+		if len(pin.img.warning) > 0 {
+			fmt.Println("  | WARNING:", pin.img.warning)
+		}
+		fmt.Printf("  | %s", strings.Join(pin.img.platforms, ", "))
+		if pin.err != nil {
+			return nil, nil, pin.err
+		}
+		fmt.Println("\n  |-> ", pin.img.pinned)
+		configs[name] = pin.configs
+		svcPlatforms[name] = append([]string(nil), pin.img.platforms...)
+		svc := services[name].(map[string]interface{})
+		svc["image"] = pin.img.pinned
+	}
+
+	platforms := intersectPlatforms(svcPlatforms)
+	if len(platforms) == 0 {
+		var names []string
+		for name := range svcPlatforms {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		msg := "Services have no platform in common:"
+		for _, name := range names {
+			msg += fmt.Sprintf("\n  %s: %s", name, strings.Join(svcPlatforms[name], ", "))
+		}
+		if !warnPlatforms {
+			return nil, nil, errors.New(msg)
+		}
+		fmt.Println("WARNING:", msg)
+	} else {
+		fmt.Println("= Supported platforms:", strings.Join(platforms, ", "))
+	}
+	return configs, platforms, nil
 }
 
 func getIgnores(appDir string) []string {
@@ -155,69 +565,125 @@ func getIgnores(appDir string) []string {
 	return ignores
 }
 
-func createTgz(composeContent []byte, appDir string, ostreeShas, specFiles map[string][]byte, unitFiles map[string][]byte) ([]byte, error) {
+// sourceDateEpoch returns the time to give every file in the bundle so that
+// publishing the same app twice produces the same digest. See:
+// https://reproducible-builds.org/specs/source-date-epoch/
+func sourceDateEpoch() (time.Time, error) {
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if len(epoch) == 0 {
+		return time.Unix(0, 0), nil
+	}
+	secs, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid SOURCE_DATE_EPOCH(%s): %s", epoch, err)
+	}
+	return time.Unix(secs, 0), nil
+}
+
+func sortedKeys(files map[string][]byte) []string {
+	keys := make([]string, 0, len(files))
+	for k := range files {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func addTarFile(tw *tar.Writer, name string, content []byte, mtime time.Time) error {
+	header := tar.Header{
+		Name:    name,
+		Size:    int64(len(content)),
+		Mode:    0755,
+		ModTime: mtime,
+	}
+	if err := tw.WriteHeader(&header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(content); err != nil {
+		return fmt.Errorf("Unable to add %s to archive: %s", name, err)
+	}
+	return nil
+}
+
+// createTgz produces the same bytes for the same input. Entries are written
+// in sorted order with normalized owners, modes and times. Configs keep the
+// owner and mode their service asks for. Go's gzip writer leaves the name
+// and mtime out of the gzip header, so it is fixed as well.
+func createTgz(composeContent []byte, appDir string, info BundleInfo, ostreeShas, specFiles map[string][]byte, unitFiles map[string][]byte, configFiles map[string]BundleFile) ([]byte, error) {
+	mtime, err := sourceDateEpoch()
+	if err != nil {
+		return nil, err
+	}
+
 	var buf bytes.Buffer
 	gzw := gzip.NewWriter(&buf)
 	tw := tar.NewWriter(gzw)
 
 	ignores := getIgnores(appDir)
 	warned := make(map[string]bool)
+	secrets := make(map[string]bool)
+	secretNames, err := secretFiles(appDir, info.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range secretNames {
+		secrets[file] = true
+	}
 
-	for name, content := range ostreeShas {
-		header := tar.Header{
-			Name: ".ostree/" + name,
-			Size: int64(len(content)),
-			Mode: 0755,
-		}
-		if err := tw.WriteHeader(&header); err != nil {
-			return nil, err
-		}
-		if _, err := tw.Write(content); err != nil {
+	for _, name := range sortedKeys(ostreeShas) {
+		if err := addTarFile(tw, ".ostree/"+name, ostreeShas[name], mtime); err != nil {
 			return nil, err
 		}
 	}
 
-	for name, content := range specFiles {
-		header := tar.Header{
-			Name: ".specs/" + name,
-			Size: int64(len(content)),
-			Mode: 0755,
-		}
-		if err := tw.WriteHeader(&header); err != nil {
+	for _, name := range sortedKeys(specFiles) {
+		if err := addTarFile(tw, ".specs/"+name, specFiles[name], mtime); err != nil {
 			return nil, err
 		}
-		if _, err := tw.Write(content); err != nil {
+	}
+
+	for _, name := range sortedKeys(unitFiles) {
+		if err := addTarFile(tw, ".systemd/"+name, unitFiles[name], mtime); err != nil {
 			return nil, err
 		}
 	}
 
-	for name, content := range unitFiles {
+	var configNames []string
+	for name := range configFiles {
+		configNames = append(configNames, name)
+	}
+	sort.Strings(configNames)
+	for _, name := range configNames {
+		config := configFiles[name]
 		header := tar.Header{
-			Name: ".systemd/" + name,
-			Size: int64(len(content)),
-			Mode: 0755,
+			Name:    name,
+			Size:    int64(len(config.Content)),
+			Mode:    int64(config.Mode.Perm()),
+			Uid:     config.UID,
+			Gid:     config.GID,
+			ModTime: mtime,
 		}
 		if err := tw.WriteHeader(&header); err != nil {
 			return nil, err
 		}
-		if _, err := tw.Write(content); err != nil {
-			return nil, err
+		if _, err := tw.Write(config.Content); err != nil {
+			return nil, fmt.Errorf("Unable to add %s to archive: %s", name, err)
 		}
 	}
 
-	header := tar.Header{
-		Name: "docker-compose.json",
-		Size: int64(len(composeContent)),
-		Mode: 0755,
+	infoContent, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
 	}
-	if err := tw.WriteHeader(&header); err != nil {
+	if err := addTarFile(tw, ".bundle.json", infoContent, mtime); err != nil {
 		return nil, err
 	}
-	if _, err := tw.Write(composeContent); err != nil {
-		return nil, fmt.Errorf("Unable to add docker-compose.json to archive: %s", err)
+
+	if err := addTarFile(tw, "docker-compose.json", composeContent, mtime); err != nil {
+		return nil, err
 	}
 
-	err := filepath.Walk(appDir, func(file string, fi os.FileInfo, err error) error {
+	err = filepath.Walk(appDir, func(file string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("Tar: Can't stat file %s to tar: %w", appDir, err)
 		}
@@ -235,6 +701,25 @@ func createTgz(composeContent []byte, appDir string, ostreeShas, specFiles map[s
 
 		// Handle subdirectories
 		header.Name = strings.TrimPrefix(strings.Replace(file, appDir, "", -1), string(filepath.Separator))
+
+		if secrets[filepath.Clean(header.Name)] {
+			fmt.Println("  |-> not bundling secret: ", header.Name)
+			return nil
+		}
+
+		// Only keep what a checkout of the app is guaranteed to reproduce
+		header.ModTime = mtime
+		header.AccessTime = time.Time{}
+		header.ChangeTime = time.Time{}
+		header.Uid = 0
+		header.Gid = 0
+		header.Uname = ""
+		header.Gname = ""
+		if header.Mode&0111 != 0 {
+			header.Mode = 0755
+		} else {
+			header.Mode = 0644
+		}
 		if ignores != nil {
 			for _, ignore := range ignores {
 				if match, err := filepath.Match(ignore, header.Name); err == nil && match {
@@ -289,13 +774,13 @@ func createTgz(composeContent []byte, appDir string, ostreeShas, specFiles map[s
 	return buf.Bytes(), nil
 }
 
-func CreateApp(ctx context.Context, config map[string]interface{}, target string, ostreeShas, specFiles map[string][]byte, unitFiles map[string][]byte, dryRun bool) (string, error) {
+func CreateApp(ctx context.Context, store ImageStore, config map[string]interface{}, target string, info BundleInfo, ostreeShas, specFiles map[string][]byte, unitFiles map[string][]byte, configFiles map[string]BundleFile, dryRun bool) (string, error) {
 	pinned, err := json.Marshal(config)
 	if err != nil {
 		return "", err
 	}
 
-	buff, err := createTgz(pinned, "./", ostreeShas, specFiles, unitFiles)
+	buff, err := createTgz(pinned, "./", info, ostreeShas, specFiles, unitFiles, configFiles)
 	if err != nil {
 		return "", err
 	}
@@ -309,8 +794,7 @@ func CreateApp(ctx context.Context, config map[string]interface{}, target string
 		tag = tagged.Tag()
 	}
 
-	regc := NewRegistryClient()
-	repo, err := regc.GetRepository(ctx, named)
+	repo, err := store.GetRepository(ctx, named)
 	if err != nil {
 		return "", err
 	}
@@ -332,7 +816,11 @@ func CreateApp(ctx context.Context, config map[string]interface{}, target string
 	}
 	fmt.Println("  |-> app: ", desc.Digest.String())
 
-	mb := ocischema.NewManifestBuilder(blobStore, []byte{}, map[string]string{"compose-app": "v1"})
+	annotations := map[string]string{"compose-app": "v1"}
+	if len(info.Platforms) > 0 {
+		annotations["compose-app-platforms"] = strings.Join(info.Platforms, ",")
+	}
+	mb := ocischema.NewManifestBuilder(blobStore, []byte{}, annotations)
 	if err := mb.AppendReference(desc); err != nil {
 		return "", err
 	}
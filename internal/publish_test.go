@@ -0,0 +1,350 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/compose-spec/compose-go/loader"
+	compose "github.com/compose-spec/compose-go/types"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const reproducibleCompose = `
+services:
+  b:
+    image: alpine:latest
+    network_mode: host
+    environment:
+      B1: one
+      B2: two
+      B3: three
+      B4: four
+      B5: five
+      B6: six
+      B7: seven
+      B8: eight
+    labels:
+      l1: one
+      l2: two
+      l3: three
+    sysctls:
+      net.core.somaxconn: 1024
+      net.ipv4.tcp_syncookies: 0
+    secrets:
+      - token
+    configs:
+      - source: app
+        target: /etc/app.conf
+        uid: "1000"
+        gid: "1001"
+        mode: 0440
+  a:
+    image: alpine:latest
+    network_mode: host
+    depends_on:
+      - b
+    environment:
+      A1: one
+      A2: two
+      A3: three
+    secrets:
+      - source: token
+        target: api-token
+secrets:
+  token:
+    file: ./secrets/token.txt
+configs:
+  app:
+    file: ./app.conf
+`
+
+func createBundle(t *testing.T, appDir string, content []byte) []byte {
+	config, err := loader.ParseYAML(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proj, err := loader.Load(compose.ConfigDetails{
+		WorkingDir:  appDir,
+		ConfigFiles: []compose.ConfigFile{{Filename: "docker-compose.yml", Config: config}},
+		Environment: map[string]string{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imgConfig := []byte(`{"architecture":"amd64","os":"linux","config":{"Env":["PATH=/usr/bin:/bin","I1=one","I2=two","I3=three","I4=four"],"Cmd":["/bin/sh"]}}`)
+	configs := make(ServiceConfigs)
+	for _, s := range proj.Services {
+		configs[s.Name] = []ContainerConfig{{Platform: "amd64", Config: imgConfig}}
+	}
+	specs, err := CreateSpecs(proj, configs, SpecOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hcs, err := Healthchecks(proj, configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stops, err := StopConfigs(proj, configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	units, err := CreateServices(proj, hcs, stops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := ServiceSecrets(proj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFiles, err := ConfigFiles(proj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := BundleInfo{Platforms: []string{"amd64"}, Healthchecks: hcs, Secrets: secrets}
+	tgz, err := createTgz(content, appDir, info, nil, specs, units, configFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tgz
+}
+
+func TestBundleIsReproducible(t *testing.T) {
+	appDir, err := ioutil.TempDir("", "capp-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(appDir)
+
+	content := []byte(reproducibleCompose)
+	files := map[string][]byte{
+		"docker-compose.yml": content,
+		"app.conf":           []byte("key=value\n"),
+		"scripts/run.sh":     []byte("#!/bin/sh\nexec true\n"),
+		"secrets/token.txt":  []byte("hunter2\n"),
+	}
+	for name, data := range files {
+		path := filepath.Join(appDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tgz := createBundle(t, appDir, content)
+	expected := digest.FromBytes(tgz)
+	for i := 0; i < 10; i++ {
+		// Neither the time the app's files were touched nor map ordering
+		// should change the bundle.
+		mtime := time.Now().Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(filepath.Join(appDir, "app.conf"), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if dgst := digest.FromBytes(createBundle(t, appDir, content)); dgst != expected {
+			t.Fatalf("Bundle %d differs: %s != %s", i, dgst, expected)
+		}
+	}
+
+	// Secrets are left for the runner to provide while configs are bundled
+	// with the ownership and mode they get mounted with.
+	gzr, err := gzip.NewReader(bytes.NewReader(tgz))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := make(map[string]*tar.Header)
+	var bundleInfo []byte
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		headers[hdr.Name] = hdr
+		if hdr.Name == ".bundle.json" {
+			if bundleInfo, err = ioutil.ReadAll(tr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for name := range headers {
+		if strings.Contains(name, "token") {
+			t.Errorf("Secret bundled as %s", name)
+		}
+	}
+	if hdr, ok := headers[".configs/b/app"]; !ok {
+		t.Errorf("Config missing from bundle: %v", headers)
+	} else if hdr.Uid != 1000 || hdr.Gid != 1001 || hdr.Mode != 0440 {
+		t.Errorf("Config bundled as %d:%d %o", hdr.Uid, hdr.Gid, hdr.Mode)
+	}
+
+	var info BundleInfo
+	if err := json.Unmarshal(bundleInfo, &info); err != nil {
+		t.Fatal(err)
+	}
+	secrets := map[string]string{}
+	for svc, mounts := range info.Secrets {
+		for _, m := range mounts {
+			secrets[svc] = m.Path + " -> " + m.Target
+		}
+	}
+	expectedSecrets := map[string]string{
+		"a": ".secrets/a/token -> /run/secrets/api-token",
+		"b": ".secrets/b/token -> /run/secrets/token",
+	}
+	if !reflect.DeepEqual(secrets, expectedSecrets) {
+		t.Errorf("Unexpected secrets in .bundle.json: %v", secrets)
+	}
+}
+
+type layerEntry struct {
+	name    string
+	content string
+	link    bool
+}
+
+// testImage adds an image made up of the given layers, bottom first, to the
+// layout and returns its manifest's digest.
+func testImage(t *testing.T, layout *OCILayout, layers ...[]layerEntry) digest.Digest {
+	t.Helper()
+	ctx := context.Background()
+	blobs := &ociBlobs{layout: layout}
+	man := ocischema.Manifest{
+		Versioned: manifest.Versioned{SchemaVersion: 2, MediaType: v1.MediaTypeImageManifest},
+		Config:    distribution.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: digest.FromString("{}"), Size: 2},
+	}
+	for _, entries := range layers {
+		var buf bytes.Buffer
+		gzw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gzw)
+		for _, e := range entries {
+			hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.content))}
+			if e.link {
+				hdr = &tar.Header{Name: e.name, Typeflag: tar.TypeSymlink, Linkname: e.content}
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if !e.link {
+				if _, err := tw.Write([]byte(e.content)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		tw.Close()
+		gzw.Close()
+		desc, err := blobs.Put(ctx, v1.MediaTypeImageLayerGzip, buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		man.Layers = append(man.Layers, desc)
+	}
+	dm, err := ocischema.FromStruct(man)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, _ := dm.Payload()
+	desc, err := blobs.Put(ctx, v1.MediaTypeImageManifest, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return desc.Digest
+}
+
+func TestGetImageFiles(t *testing.T) {
+	passwd := layerEntry{name: "etc/passwd", content: "root:x:0:0::/root:/bin/sh\n"}
+	group := layerEntry{name: "etc/group", content: "root:x:0:\n"}
+	appPasswd := layerEntry{name: "etc/passwd", content: "app:x:1000:1000::/:/bin/sh\n"}
+	tests := []struct {
+		name   string
+		layers [][]layerEntry
+		passwd string
+		group  string
+	}{
+		{
+			name:   "single layer",
+			layers: [][]layerEntry{{passwd, group}},
+			passwd: passwd.content,
+			group:  group.content,
+		},
+		{
+			name:   "upper layer wins",
+			layers: [][]layerEntry{{passwd, group}, {appPasswd}},
+			passwd: appPasswd.content,
+			group:  group.content,
+		},
+		{
+			name:   "whited out",
+			layers: [][]layerEntry{{passwd, group}, {{name: "etc/.wh.passwd"}}},
+			group:  group.content,
+		},
+		{
+			name:   "whited out and added back",
+			layers: [][]layerEntry{{passwd, group}, {{name: "etc/.wh.passwd"}, appPasswd}},
+			passwd: appPasswd.content,
+			group:  group.content,
+		},
+		{
+			name:   "directory whited out",
+			layers: [][]layerEntry{{passwd, group}, {{name: ".wh.etc"}}},
+		},
+		{
+			name:   "opaque directory",
+			layers: [][]layerEntry{{passwd, group}, {{name: "etc/.wh..wh..opq"}, appPasswd}},
+			passwd: appPasswd.content,
+		},
+		{
+			name:   "opaque directory elsewhere",
+			layers: [][]layerEntry{{passwd, group}, {{name: "etc/ssl/.wh..wh..opq"}}},
+			passwd: passwd.content,
+			group:  group.content,
+		},
+		{
+			name:   "leading ./",
+			layers: [][]layerEntry{{{name: "./etc/passwd", content: passwd.content}}},
+			passwd: passwd.content,
+		},
+		{
+			name:   "not a regular file",
+			layers: [][]layerEntry{{passwd}, {{name: "etc/passwd", content: "/elsewhere", link: true}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			layout, _ := testLayout(t)
+			dgst := testImage(t, layout, tt.layers...)
+			mansvc := &ociManifests{repo: &ociRepository{layout: layout}}
+			files, err := getImageFiles(ctx, mansvc, &ociBlobs{layout: layout}, dgst, "etc/passwd", "etc/group")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, expected := range map[string]string{"etc/passwd": tt.passwd, "etc/group": tt.group} {
+				content, ok := files[name]
+				if len(expected) == 0 && ok {
+					t.Errorf("%s: expected it to be missing, got %q", name, content)
+				} else if string(content) != expected {
+					t.Errorf("%s: got %q, expected %q", name, content, expected)
+				}
+			}
+		})
+	}
+}
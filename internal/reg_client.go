@@ -2,17 +2,25 @@ package internal
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/config/credentials"
 	"github.com/docker/distribution"
 	"github.com/docker/distribution/reference"
 	distributionclient "github.com/docker/distribution/registry/client"
 	"github.com/docker/distribution/registry/client/auth"
+	"github.com/docker/distribution/registry/client/auth/challenge"
 	"github.com/docker/distribution/registry/client/transport"
 	"github.com/docker/docker/api/types"
 	registrytypes "github.com/docker/docker/api/types/registry"
@@ -21,39 +29,236 @@ import (
 )
 
 // AuthConfigResolver returns Auth Configuration for an index
-type AuthConfigResolver func(ctx context.Context, index *registrytypes.IndexInfo) types.AuthConfig
+type AuthConfigResolver func(ctx context.Context, index *registrytypes.IndexInfo) (types.AuthConfig, error)
 
+// Environment variables CI can give registry credentials in
+const (
+	registryEnvHost  = "CAPP_REGISTRY"
+	registryEnvUser  = "CAPP_REGISTRY_USER"
+	registryEnvToken = "CAPP_REGISTRY_TOKEN"
+)
+
+// RegistryOptions configure how registries are connected to.
+type RegistryOptions struct {
+	// InsecureRegistries, given as host[:port] or CIDR, have their
+	// certificates go unverified and can be reached over plain http.
+	InsecureRegistries []string
+	// CertsDir holds a directory per registry host[:port] with its CA
+	// certificates (*.crt) and client certificate pairs (*.cert, *.key)
+	// like /etc/docker/certs.d does.
+	CertsDir string
+	// CACert is a bundle of CA certificates trusted for every registry.
+	CACert string
+	// ClientCert and ClientKey are a certificate pair presented to every
+	// registry.
+	ClientCert string
+	ClientKey  string
+	// ConfigFile is the docker config.json to read credentials from rather
+	// than ~/.docker/config.json.
+	ConfigFile string
+	// Attempts is how many times a request failing with a transient
+	// connection error, 5xx or 429 is tried. Defaults to DefaultRegistryAttempts.
+	Attempts int
+}
+
+// RegistryClient is safe to use from multiple goroutines. Registries are
+// only pinged once and each repository's transport, along with the tokens
+// it has been granted, is shared by everything using the repository.
 type RegistryClient struct {
 	authConfigResolver AuthConfigResolver
-	insecureRegistry   bool
+	service            *registry.DefaultService
+	certsDir           string
+	caCerts            []byte
+	certificates       []tls.Certificate
 	userAgent          string
+	attempts           int
+
+	mu         sync.Mutex
+	pings      map[string]*registryPing
+	transports map[string]*repoTransport
+}
+
+// registryPing is the outcome of pinging a registry endpoint.
+type registryPing struct {
+	once    sync.Once
+	manager challenge.Manager
+	err     error
 }
 
-func ResolveAuthConfig(ctx context.Context, index *registrytypes.IndexInfo) types.AuthConfig {
-	cfg := config.LoadDefaultConfigFile(os.Stderr)
-	a, _ := cfg.GetAuthConfig(index.Name)
-	return types.AuthConfig(a)
+// repoTransport is the transport for a repository of a registry endpoint.
+type repoTransport struct {
+	once      sync.Once
+	transport http.RoundTripper
+	err       error
 }
 
-func NewRegistryClient() RegistryClient {
-	resolver := func(ctx context.Context, index *registrytypes.IndexInfo) types.AuthConfig {
-		return ResolveAuthConfig(ctx, index)
+// loadDockerConfig reads the docker config file holding registry
+// credentials along with the credHelpers and credsStore to get them from.
+func loadDockerConfig(path string) (*configfile.ConfigFile, error) {
+	var cfg *configfile.ConfigFile
+	if len(path) == 0 {
+		var err error
+		if cfg, err = config.Load(config.Dir()); err != nil {
+			return nil, fmt.Errorf("Unable to load docker config: %s", err)
+		}
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load registry config: %s", err)
+		}
+		defer f.Close()
+		cfg = configfile.New(path)
+		if err := cfg.LoadFromReader(f); err != nil {
+			return nil, fmt.Errorf("Unable to load registry config %s: %s", path, err)
+		}
 	}
+	if !cfg.ContainsAuth() {
+		cfg.CredentialsStore = credentials.DetectDefaultStore(cfg.CredentialsStore)
+	}
+	return cfg, nil
+}
 
-	return RegistryClient{
+// envAuthConfig returns the credentials given in the environment for the
+// registry, if any. They're used for every registry unless CAPP_REGISTRY
+// names the one they're for. A token without a user is sent as a bearer
+// token.
+func envAuthConfig(index *registrytypes.IndexInfo) (types.AuthConfig, bool) {
+	user := os.Getenv(registryEnvUser)
+	token := os.Getenv(registryEnvToken)
+	if len(user) == 0 && len(token) == 0 {
+		return types.AuthConfig{}, false
+	}
+	if host := os.Getenv(registryEnvHost); len(host) > 0 && host != index.Name {
+		return types.AuthConfig{}, false
+	}
+	if len(user) == 0 {
+		return types.AuthConfig{RegistryToken: token}, true
+	}
+	return types.AuthConfig{Username: user, Password: token}, true
+}
+
+// ResolveAuthConfig finds the credentials for a registry in the environment
+// or, failing that, in the docker config file.
+func ResolveAuthConfig(ctx context.Context, cfg *configfile.ConfigFile, index *registrytypes.IndexInfo) (types.AuthConfig, error) {
+	if auth, ok := envAuthConfig(index); ok {
+		return auth, nil
+	}
+	a, err := cfg.GetAuthConfig(registry.GetAuthConfigKey(index))
+	if err != nil {
+		return types.AuthConfig{}, fmt.Errorf("Unable to get credentials for registry %s: %s", index.Name, err)
+	}
+	return types.AuthConfig(a), nil
+}
+
+func NewRegistryClient(opts RegistryOptions) (*RegistryClient, error) {
+	cfg, err := loadDockerConfig(opts.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	resolver := func(ctx context.Context, index *registrytypes.IndexInfo) (types.AuthConfig, error) {
+		return ResolveAuthConfig(ctx, cfg, index)
+	}
+
+	c := &RegistryClient{
 		authConfigResolver: resolver,
-		insecureRegistry:   false,
+		certsDir:           opts.CertsDir,
 		userAgent:          "Compose-Ref",
+		attempts:           opts.Attempts,
+		pings:              make(map[string]*registryPing),
+		transports:         make(map[string]*repoTransport),
+	}
+
+	service, err := registry.NewService(registry.ServiceOptions{InsecureRegistries: opts.InsecureRegistries})
+	if err != nil {
+		return nil, err
+	}
+	c.service = service
+
+	if c.attempts == 0 {
+		c.attempts = DefaultRegistryAttempts
+	} else if c.attempts < 0 {
+		return nil, fmt.Errorf("Invalid number of registry attempts: %d", c.attempts)
+	}
+
+	if len(opts.CACert) > 0 {
+		c.caCerts, err = ioutil.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read CA certificates: %s", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(c.caCerts) {
+			return nil, fmt.Errorf("No CA certificates found in %s", opts.CACert)
+		}
+	}
+
+	if len(opts.ClientCert) > 0 || len(opts.ClientKey) > 0 {
+		if len(opts.ClientCert) == 0 || len(opts.ClientKey) == 0 {
+			return nil, errors.New("A client certificate and its key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load client certificate: %s", err)
+		}
+		c.certificates = []tls.Certificate{cert}
 	}
+	return c, nil
 }
 
+// GetRepository connects to the first of the registry's endpoints that
+// responds. An insecure registry is tried over https before falling back to
+// plain http.
 func (c *RegistryClient) GetRepository(ctx context.Context, ref reference.Named) (distribution.Repository, error) {
-	repoEndpoint, err := newDefaultRepositoryEndpoint(ref, c.insecureRegistry)
+	repoInfo, err := c.service.ResolveRepository(ref)
 	if err != nil {
 		return nil, err
 	}
+	endpoints, err := c.service.LookupPushEndpoints(reference.Domain(repoInfo.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	// Report why the preferred endpoint failed rather than the fallback
+	var firstErr error
+	for _, endpoint := range endpoints {
+		repoEndpoint := repositoryEndpoint{info: repoInfo, endpoint: endpoint}
+		repo, err := c.getRepositoryForReference(ctx, ref, repoEndpoint)
+		if err == nil {
+			return repo, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// tlsConfig adds the configured CA certificates and client certificates to
+// those docker found for the endpoint.
+func (c *RegistryClient) tlsConfig(endpoint registry.APIEndpoint) (*tls.Config, error) {
+	config := &tls.Config{}
+	if endpoint.TLSConfig != nil {
+		config = endpoint.TLSConfig.Clone()
+	}
+	if endpoint.URL.Scheme != "https" {
+		return config, nil
+	}
 
-	return c.getRepositoryForReference(ctx, ref, repoEndpoint)
+	if len(c.caCerts) > 0 && !config.InsecureSkipVerify {
+		if config.RootCAs == nil {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = pool
+		}
+		config.RootCAs.AppendCertsFromPEM(c.caCerts)
+	}
+	config.Certificates = append(config.Certificates, c.certificates...)
+	if len(c.certsDir) > 0 {
+		if err := registry.ReadCertsDirectory(config, filepath.Join(c.certsDir, endpoint.URL.Host)); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
 }
 
 func (c *RegistryClient) getRepositoryForReference(ctx context.Context, ref reference.Named, repoEndpoint repositoryEndpoint) (distribution.Repository, error) {
@@ -69,18 +274,78 @@ func (c *RegistryClient) getRepositoryForReference(ctx context.Context, ref refe
 }
 
 func (c *RegistryClient) getHTTPTransportForRepoEndpoint(ctx context.Context, repoEndpoint repositoryEndpoint) (http.RoundTripper, error) {
-	httpTransport, err := getHTTPTransport(
-		c.authConfigResolver(ctx, repoEndpoint.info.Index),
-		repoEndpoint.endpoint,
+	key := repoEndpoint.BaseURL() + "/" + repoEndpoint.Name()
+	c.mu.Lock()
+	rt, ok := c.transports[key]
+	if !ok {
+		rt = &repoTransport{}
+		c.transports[key] = rt
+	}
+	c.mu.Unlock()
+
+	rt.once.Do(func() {
+		rt.transport, rt.err = c.newHTTPTransport(ctx, repoEndpoint)
+	})
+	return rt.transport, rt.err
+}
+
+func (c *RegistryClient) newHTTPTransport(ctx context.Context, repoEndpoint repositoryEndpoint) (http.RoundTripper, error) {
+	tlsConfig, err := c.tlsConfig(repoEndpoint.endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure TLS")
+	}
+	authConfig, err := c.authConfigResolver(ctx, repoEndpoint.info.Index)
+	if err != nil {
+		return nil, err
+	}
+	challengeManager, err := c.ping(repoEndpoint.endpoint, tlsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure transport")
+	}
+	httpTransport := getHTTPTransport(
+		authConfig,
+		challengeManager,
+		tlsConfig,
 		repoEndpoint.Name(),
-		c.userAgent)
-	return httpTransport, errors.Wrap(err, "failed to configure transport")
+		c.userAgent,
+		c.attempts)
+	return &authErrorTransport{
+		base:     httpTransport,
+		registry: repoEndpoint.info.Index.Name,
+		hasCreds: authConfig != types.AuthConfig{},
+	}, nil
 }
 
-// getHTTPTransport builds a transport for use in communicating with a registry
-func getHTTPTransport(authConfig types.AuthConfig, endpoint registry.APIEndpoint, repoName string, userAgent string) (http.RoundTripper, error) {
-	// get the http transport, this will be used in a client to upload manifest
-	base := &http.Transport{
+// ping finds out how a registry endpoint wants requests authorized. Each
+// endpoint is only pinged once.
+func (c *RegistryClient) ping(endpoint registry.APIEndpoint, tlsConfig *tls.Config) (challenge.Manager, error) {
+	key := endpoint.URL.String()
+	c.mu.Lock()
+	p, ok := c.pings[key]
+	if !ok {
+		p = &registryPing{}
+		c.pings[key] = p
+	}
+	c.mu.Unlock()
+
+	p.once.Do(func() {
+		modifiers := registry.Headers(c.userAgent, http.Header{})
+		pingTransport := transport.NewTransport(newBaseTransport(tlsConfig, c.attempts), modifiers...)
+		var confirmedV2 bool
+		p.manager, confirmedV2, p.err = registry.PingV2Registry(endpoint.URL, pingTransport)
+		if p.err != nil {
+			p.err = errors.Wrap(p.err, "error pinging v2 registry")
+		} else if !confirmedV2 {
+			p.err = fmt.Errorf("unsupported registry version")
+		}
+	})
+	return p.manager, p.err
+}
+
+// newBaseTransport returns the transport requests to a registry go out on,
+// retrying transient failures up to attempts times.
+func newBaseTransport(tlsConfig *tls.Config, attempts int) http.RoundTripper {
+	return newRetryTransport(&http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		Dial: (&net.Dialer{
 			Timeout:   30 * time.Second,
@@ -88,19 +353,45 @@ func getHTTPTransport(authConfig types.AuthConfig, endpoint registry.APIEndpoint
 			DualStack: true,
 		}).Dial,
 		TLSHandshakeTimeout: 10 * time.Second,
-		TLSClientConfig:     endpoint.TLSConfig,
+		TLSClientConfig:     tlsConfig,
 		DisableKeepAlives:   true,
+	}, attempts)
+}
+
+// authErrorTransport turns a registry's 401 responses into an error naming
+// the registry rather than the opaque "unauthorized" the distribution client
+// reports.
+type authErrorTransport struct {
+	base     http.RoundTripper
+	registry string
+	hasCreds bool
+}
+
+func (t *authErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == auth.ErrNoBasicAuthCredentials {
+		return nil, t.missingCreds()
+	} else if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
 	}
+	resp.Body.Close()
+	if !t.hasCreds {
+		return nil, t.missingCreds()
+	}
+	return nil, fmt.Errorf("Registry %s rejected the credentials for %s", t.registry, req.URL.Path)
+}
+
+func (t *authErrorTransport) missingCreds() error {
+	return fmt.Errorf("Registry %s requires authentication and no credentials were found. Set %s and %s, use --registry-config or run docker login", t.registry, registryEnvUser, registryEnvToken)
+}
+
+// getHTTPTransport builds a transport for use in communicating with a registry
+func getHTTPTransport(authConfig types.AuthConfig, challengeManager challenge.Manager, tlsConfig *tls.Config, repoName string, userAgent string, attempts int) http.RoundTripper {
+	// get the http transport, this will be used in a client to upload manifest
+	base := newBaseTransport(tlsConfig, attempts)
 
 	modifiers := registry.Headers(userAgent, http.Header{})
 	authTransport := transport.NewTransport(base, modifiers...)
-	challengeManager, confirmedV2, err := registry.PingV2Registry(endpoint.URL, authTransport)
-	if err != nil {
-		return nil, errors.Wrap(err, "error pinging v2 registry")
-	}
-	if !confirmedV2 {
-		return nil, fmt.Errorf("unsupported registry version")
-	}
 	if authConfig.RegistryToken != "" {
 		passThruTokenHandler := &existingTokenHandler{token: authConfig.RegistryToken}
 		modifiers = append(modifiers, auth.NewAuthorizer(challengeManager, passThruTokenHandler))
@@ -110,7 +401,7 @@ func getHTTPTransport(authConfig types.AuthConfig, endpoint registry.APIEndpoint
 		basicHandler := auth.NewBasicHandler(creds)
 		modifiers = append(modifiers, auth.NewAuthorizer(challengeManager, tokenHandler, basicHandler))
 	}
-	return transport.NewTransport(base, modifiers...), nil
+	return transport.NewTransport(base, modifiers...)
 }
 
 type existingTokenHandler struct {
@@ -145,42 +436,3 @@ func (r repositoryEndpoint) Name() string {
 func (r repositoryEndpoint) BaseURL() string {
 	return r.endpoint.URL.String()
 }
-
-func newDefaultRepositoryEndpoint(ref reference.Named, insecure bool) (repositoryEndpoint, error) {
-	repoInfo, err := registry.ParseRepositoryInfo(ref)
-	if err != nil {
-		return repositoryEndpoint{}, err
-	}
-	endpoint, err := getDefaultEndpointFromRepoInfo(repoInfo)
-	if err != nil {
-		return repositoryEndpoint{}, err
-	}
-	if insecure {
-		endpoint.TLSConfig.InsecureSkipVerify = true
-	}
-	return repositoryEndpoint{info: repoInfo, endpoint: endpoint}, nil
-}
-
-func getDefaultEndpointFromRepoInfo(repoInfo *registry.RepositoryInfo) (registry.APIEndpoint, error) {
-	var err error
-
-	options := registry.ServiceOptions{}
-	registryService, err := registry.NewService(options)
-	if err != nil {
-		return registry.APIEndpoint{}, err
-	}
-	endpoints, err := registryService.LookupPushEndpoints(reference.Domain(repoInfo.Name))
-	if err != nil {
-		return registry.APIEndpoint{}, err
-	}
-	// Default to the highest priority endpoint to return
-	endpoint := endpoints[0]
-	if !repoInfo.Index.Secure {
-		for _, ep := range endpoints {
-			if ep.URL.Scheme == "http" {
-				endpoint = ep
-			}
-		}
-	}
-	return endpoint, nil
-}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultRegistryAttempts is how many times a registry request is tried
+	// before giving up.
+	DefaultRegistryAttempts = 5
+
+	retryInitialDelay = 500 * time.Millisecond
+	retryMaxDelay     = 30 * time.Second
+	// Longest Retry-After honored so a misbehaving registry can't stall a
+	// publish indefinitely.
+	retryMaxRetryAfter = 2 * time.Minute
+)
+
+// retryTransport retries registry requests that fail with a transient
+// connection error, a 5xx or a 429 using exponential backoff. A Retry-After
+// header in the response takes the place of the backoff delay.
+type retryTransport struct {
+	base         http.RoundTripper
+	attempts     int
+	initialDelay time.Duration
+}
+
+func newRetryTransport(base http.RoundTripper, attempts int) http.RoundTripper {
+	if attempts <= 1 {
+		return base
+	}
+	return &retryTransport{base: base, attempts: attempts, initialDelay: retryInitialDelay}
+}
+
+// sleepRequest waits for the delay or until the request is cancelled.
+func sleepRequest(req *http.Request, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// retryableStatus is true for responses worth trying again.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryableError is true for connection failures that are likely to go away.
+// Other failures, like a TLS handshake with a plain http registry, won't.
+func retryableError(err error) bool {
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	val := resp.Header.Get("Retry-After")
+	if len(val) == 0 {
+		return 0, false
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(val); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(val); err == nil {
+		d = t.Sub(now)
+	} else {
+		return 0, false
+	}
+	if d < 0 {
+		d = 0
+	} else if d > retryMaxRetryAfter {
+		d = retryMaxRetryAfter
+	}
+	return d, true
+}
+
+// rewind gives the request a fresh body for another attempt. Requests with
+// bodies that can't be replayed, like streamed blob uploads, aren't retried.
+func rewind(req *http.Request) (*http.Request, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	clone := req.Clone(req.Context())
+	clone.Body = body
+	return clone, true
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	delay := t.initialDelay
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if attempt >= t.attempts {
+			return resp, err
+		}
+
+		var reason string
+		wait := delay
+		if err != nil {
+			if req.Context().Err() != nil || !retryableError(err) {
+				return resp, err
+			}
+			reason = err.Error()
+		} else if retryableStatus(resp.StatusCode) {
+			reason = resp.Status
+			if d, ok := retryAfter(resp, time.Now()); ok {
+				wait = d
+			}
+		} else {
+			return resp, err
+		}
+
+		next, ok := rewind(req)
+		if !ok {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+
+		log.Printf("WARNING: %s %s failed on attempt %d of %d: %s, retrying in %s",
+			req.Method, req.URL.Redacted(), attempt, t.attempts, reason, wait)
+		if err := sleepRequest(req, wait); err != nil {
+			return nil, err
+		}
+		req = next
+		delay *= 2
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// faultyRegistry answers each request with the next of its faults, and then
+// with a 200 once they run out.
+type faultyRegistry struct {
+	mu     sync.Mutex
+	faults []func(w http.ResponseWriter)
+	hits   int
+	bodies []string
+}
+
+func (f *faultyRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.mu.Lock()
+	f.hits++
+	f.bodies = append(f.bodies, string(body))
+	var fault func(w http.ResponseWriter)
+	if len(f.faults) > 0 {
+		fault, f.faults = f.faults[0], f.faults[1:]
+	}
+	f.mu.Unlock()
+
+	if fault != nil {
+		fault(w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func (f *faultyRegistry) requests() (int, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hits, append([]string{}, f.bodies...)
+}
+
+func status(code int) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.WriteHeader(code)
+	}
+}
+
+func retryAfterStatus(code int, after string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", after)
+		w.WriteHeader(code)
+	}
+}
+
+// dropConnection resets the connection without a response.
+func dropConnection(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func newTestRetryTransport(attempts int) *retryTransport {
+	return &retryTransport{
+		base:         &http.Transport{DisableKeepAlives: true},
+		attempts:     attempts,
+		initialDelay: time.Millisecond,
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		faults   []func(w http.ResponseWriter)
+		status   int
+		hits     int
+	}{
+		{
+			name:     "success",
+			attempts: 3,
+			status:   http.StatusOK,
+			hits:     1,
+		},
+		{
+			name:     "5xx recovered",
+			attempts: 5,
+			faults: []func(w http.ResponseWriter){
+				status(http.StatusInternalServerError),
+				status(http.StatusBadGateway),
+				status(http.StatusServiceUnavailable),
+				status(http.StatusGatewayTimeout),
+			},
+			status: http.StatusOK,
+			hits:   5,
+		},
+		{
+			name:     "429 recovered",
+			attempts: 2,
+			faults:   []func(w http.ResponseWriter){retryAfterStatus(http.StatusTooManyRequests, "0")},
+			status:   http.StatusOK,
+			hits:     2,
+		},
+		{
+			name:     "dropped connection recovered",
+			attempts: 3,
+			faults:   []func(w http.ResponseWriter){dropConnection, dropConnection},
+			status:   http.StatusOK,
+			hits:     3,
+		},
+		{
+			name:     "attempts exhausted",
+			attempts: 3,
+			faults: []func(w http.ResponseWriter){
+				status(http.StatusServiceUnavailable),
+				status(http.StatusServiceUnavailable),
+				status(http.StatusServiceUnavailable),
+			},
+			status: http.StatusServiceUnavailable,
+			hits:   3,
+		},
+		{
+			name:     "client errors not retried",
+			attempts: 3,
+			faults:   []func(w http.ResponseWriter){status(http.StatusNotFound)},
+			status:   http.StatusNotFound,
+			hits:     1,
+		},
+		{
+			name:     "unauthorized not retried",
+			attempts: 3,
+			faults:   []func(w http.ResponseWriter){status(http.StatusUnauthorized)},
+			status:   http.StatusUnauthorized,
+			hits:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := &faultyRegistry{faults: tt.faults}
+			srv := httptest.NewServer(reg)
+			defer srv.Close()
+
+			req, _ := http.NewRequest("GET", srv.URL+"/v2/", nil)
+			resp, err := newTestRetryTransport(tt.attempts).RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, expected %d", resp.StatusCode, tt.status)
+			}
+			if hits, _ := reg.requests(); hits != tt.hits {
+				t.Errorf("got %d requests, expected %d", hits, tt.hits)
+			}
+		})
+	}
+}
+
+func TestRetryTransportDroppedConnectionExhausted(t *testing.T) {
+	reg := &faultyRegistry{faults: []func(w http.ResponseWriter){dropConnection, dropConnection}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/v2/", nil)
+	_, err := newTestRetryTransport(2).RoundTrip(req)
+	if err == nil {
+		t.Fatal("expected the last connection error")
+	}
+	if hits, _ := reg.requests(); hits != 2 {
+		t.Errorf("got %d requests, expected 2", hits)
+	}
+}
+
+func TestRetryTransportRewindsBody(t *testing.T) {
+	reg := &faultyRegistry{faults: []func(w http.ResponseWriter){status(http.StatusBadGateway), dropConnection}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("PUT", srv.URL+"/v2/app/manifests/v1", bytes.NewReader([]byte("manifest")))
+	resp, err := newTestRetryTransport(3).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+	if _, bodies := reg.requests(); len(bodies) != 3 || bodies[2] != "manifest" {
+		t.Errorf("body wasn't replayed: %q", bodies)
+	}
+}
+
+func TestRetryTransportNonRewindableBody(t *testing.T) {
+	reg := &faultyRegistry{faults: []func(w http.ResponseWriter){status(http.StatusBadGateway)}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	// A streamed upload can't be sent again so the failure is returned
+	body := ioutil.NopCloser(strings.NewReader("layer"))
+	req, _ := http.NewRequest("PATCH", srv.URL+"/v2/app/blobs/uploads/1", body)
+	resp, err := newTestRetryTransport(3).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, expected %d", resp.StatusCode, http.StatusBadGateway)
+	}
+	if hits, _ := reg.requests(); hits != 1 {
+		t.Errorf("got %d requests, expected 1", hits)
+	}
+}
+
+func TestRetryTransportHonorsRetryAfter(t *testing.T) {
+	reg := &faultyRegistry{faults: []func(w http.ResponseWriter){retryAfterStatus(http.StatusTooManyRequests, "1")}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	start := time.Now()
+	req, _ := http.NewRequest("GET", srv.URL+"/v2/", nil)
+	resp, err := newTestRetryTransport(2).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s rather than the 1s asked for", elapsed)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+}
+
+func TestRetryTransportCancelled(t *testing.T) {
+	reg := &faultyRegistry{faults: []func(w http.ResponseWriter){retryAfterStatus(http.StatusServiceUnavailable, "60")}}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/v2/", nil)
+	_, err := newTestRetryTransport(3).RoundTrip(req)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the wait to be cancelled, got %v", err)
+	}
+}
+
+func TestRetryTransportRefusedNotRetried(t *testing.T) {
+	srv := httptest.NewServer(&faultyRegistry{})
+	url := srv.URL
+	srv.Close()
+
+	// A retry would wait out the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rt := newTestRetryTransport(3)
+	rt.initialDelay = time.Hour
+	req, _ := http.NewRequestWithContext(ctx, "GET", url+"/v2/", nil)
+	_, err := rt.RoundTrip(req)
+	if err == nil || err == context.DeadlineExceeded {
+		t.Fatalf("expected the connection to be refused, got %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header   string
+		expected time.Duration
+		ok       bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"-5", 0, true},
+		{"86400", retryMaxRetryAfter, true},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{now.Add(-30 * time.Second).Format(http.TimeFormat), 0, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if len(tt.header) > 0 {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		d, ok := retryAfter(resp, now)
+		if d != tt.expected || ok != tt.ok {
+			t.Errorf("Retry-After(%s): got %s %v, expected %s %v", tt.header, d, ok, tt.expected, tt.ok)
+		}
+	}
+}
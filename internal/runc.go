@@ -1,8 +1,12 @@
 package internal
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"sort"
+	"strconv"
 	"strings"
 
 	compose "github.com/compose-spec/compose-go/types"
@@ -11,6 +15,8 @@ import (
 	"github.com/docker/docker/oci/caps"
 	"github.com/docker/docker/pkg/system"
 	"github.com/docker/docker/profiles/seccomp"
+	units "github.com/docker/go-units"
+	"github.com/opencontainers/runc/libcontainer/user"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"github.com/pkg/errors"
 )
@@ -41,7 +47,8 @@ func env(s compose.ServiceConfig, c container.Config) []string {
 		}
 	}
 
-	// now override with service vals
+	// now override with service vals. The loader has already merged the
+	// service's env_file entries into its environment.
 	for k, v := range s.Environment {
 		envMap[k] = v
 	}
@@ -69,6 +76,7 @@ func env(s compose.ServiceConfig, c container.Config) []string {
 			env = append(env, k)
 		}
 	}
+	sort.Strings(env)
 	return env
 }
 
@@ -162,6 +170,352 @@ func setCapabilities(spec *specs.Spec, svc compose.ServiceConfig, c container.Co
 	return oci.SetCapabilities(spec, capabilities)
 }
 
+// Based on WithUser from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/oci_linux.go
+func setUser(spec *specs.Spec, svc compose.ServiceConfig, c container.Config, passwd, group []byte) error {
+	username := c.User
+	if len(svc.User) > 0 {
+		username = svc.User
+	}
+
+	// GetExecUser needs a nil interface, not a nil *bytes.Reader, when
+	// the image doesn't have one of these files.
+	var passwdReader, groupReader io.Reader
+	if passwd != nil {
+		passwdReader = bytes.NewReader(passwd)
+	}
+	if group != nil {
+		groupReader = bytes.NewReader(group)
+	}
+	execUser, err := user.GetExecUser(username, nil, passwdReader, groupReader)
+	if err != nil {
+		return fmt.Errorf("Unable to resolve user(%s): %s", username, err)
+	}
+	spec.Process.User.UID = uint32(execUser.Uid)
+	spec.Process.User.GID = uint32(execUser.Gid)
+	spec.Process.User.AdditionalGids = nil
+	for _, gid := range execUser.Sgids {
+		spec.Process.User.AdditionalGids = append(spec.Process.User.AdditionalGids, uint32(gid))
+	}
+	return nil
+}
+
+// MemSwappinessExtension is the service extension holding mem_swappiness
+// when it's given. compose-go leaves an unset mem_swappiness as 0 which is
+// also the value it's most often set to.
+const MemSwappinessExtension = "x-capp-mem-swappiness"
+
+// memSwappiness returns the service's mem_swappiness and whether it was set.
+func memSwappiness(svc compose.ServiceConfig) (int64, bool) {
+	if val, ok := svc.Extensions[MemSwappinessExtension].(int64); ok {
+		return val, true
+	}
+	return int64(svc.MemSwappiness), svc.MemSwappiness != 0
+}
+
+// Based on WithResources from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/oci_linux.go
+// along with the defaults and checks Docker applies in daemon_unix.go. The
+// values use the cgroup v1 semantics of the OCI spec (e.g. swap is memory
+// plus swap) which runtimes translate when running under cgroup v2. There's
+// no cgroup v2 equivalent of mem_swappiness so it only applies to v1 hosts.
+func setResources(spec *specs.Spec, svc compose.ServiceConfig) error {
+	const minMemory = 4 * 1024 * 1024
+
+	memory := specs.LinuxMemory{}
+	if svc.MemLimit > 0 {
+		if svc.MemLimit < minMemory {
+			return errors.New("Minimum memory limit allowed is 4MB")
+		}
+		limit := int64(svc.MemLimit)
+		memory.Limit = &limit
+	}
+	if svc.MemSwapLimit != 0 {
+		if svc.MemLimit == 0 {
+			return errors.New("mem_limit must be set when using memswap_limit")
+		}
+		if svc.MemSwapLimit > 0 && svc.MemSwapLimit < svc.MemLimit {
+			return errors.New("memswap_limit must be larger than mem_limit")
+		}
+		swap := int64(svc.MemSwapLimit)
+		memory.Swap = &swap
+	} else if svc.MemLimit > 0 {
+		// By default, Docker gives a container as much swap as memory
+		swap := int64(svc.MemLimit) * 2
+		memory.Swap = &swap
+	}
+	if svc.MemReservation > 0 {
+		if svc.MemReservation < minMemory {
+			return errors.New("Minimum memory reservation allowed is 4MB")
+		}
+		if svc.MemLimit > 0 && svc.MemLimit < svc.MemReservation {
+			return errors.New("mem_limit can not be less than mem_reservation")
+		}
+		reservation := int64(svc.MemReservation)
+		memory.Reservation = &reservation
+	}
+	if swappiness, ok := memSwappiness(svc); ok && swappiness != -1 {
+		if swappiness < 0 || swappiness > 100 {
+			return fmt.Errorf("Invalid mem_swappiness: %d, valid range is 0-100", swappiness)
+		}
+		val := uint64(swappiness)
+		memory.Swappiness = &val
+	}
+	if svc.OomKillDisable {
+		memory.DisableOOMKiller = &svc.OomKillDisable
+	}
+
+	cpu := specs.LinuxCPU{}
+	if svc.CPUShares > 0 {
+		shares := uint64(svc.CPUShares)
+		cpu.Shares = &shares
+	}
+	if len(svc.CPUSet) > 0 {
+		cpu.Cpus = svc.CPUSet
+	}
+	if svc.CPUPeriod > 0 {
+		if svc.CPUPeriod < 1000 || svc.CPUPeriod > 1000000 {
+			return errors.New("cpu_period can not be less than 1ms (i.e. 1000) or larger than 1s (i.e. 1000000)")
+		}
+		period := uint64(svc.CPUPeriod)
+		cpu.Period = &period
+	}
+	if svc.CPUQuota > 0 {
+		if svc.CPUQuota < 1000 {
+			return errors.New("cpu_quota can not be less than 1ms (i.e. 1000)")
+		}
+		quota := svc.CPUQuota
+		cpu.Quota = &quota
+	}
+
+	spec.Linux.Resources.Memory = &memory
+	spec.Linux.Resources.CPU = &cpu
+	if svc.PidLimit > 0 {
+		spec.Linux.Resources.Pids = &specs.LinuxPids{Limit: svc.PidLimit}
+	} else if svc.PidLimit < 0 {
+		spec.Linux.Resources.Pids = &specs.LinuxPids{Limit: -1}
+	}
+	return nil
+}
+
+// Based on WithRlimits from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/oci_linux.go
+// The limits are validated the same way the docker CLI does with
+// units.ParseUlimit. A limit of -1 means unlimited.
+func setRlimits(spec *specs.Spec, svc compose.ServiceConfig) error {
+	var names []string
+	for name := range svc.Ulimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var rlimits []specs.POSIXRlimit
+	for _, name := range names {
+		limit := svc.Ulimits[name]
+		soft, hard := limit.Soft, limit.Hard
+		if limit.Single != 0 {
+			soft, hard = limit.Single, limit.Single
+		}
+		ul, err := units.ParseUlimit(fmt.Sprintf("%s=%d:%d", name, soft, hard))
+		if err != nil {
+			return fmt.Errorf("Invalid ulimit(%s): %s", name, err)
+		}
+		rlimits = append(rlimits, specs.POSIXRlimit{
+			Type: "RLIMIT_" + strings.ToUpper(ul.Name),
+			Soft: uint64(ul.Soft),
+			Hard: uint64(ul.Hard),
+		})
+	}
+	spec.Process.Rlimits = rlimits
+	return nil
+}
+
+// SpecOptions are the publish wide settings used when creating specs.
+type SpecOptions struct {
+	// UsernsRemap, when set, runs containers in a user namespace with
+	// root mapped to this range of host ids. Services opt out with
+	// `userns_mode: host`.
+	UsernsRemap []specs.LinuxIDMapping
+	// InitPath is where the runner provides the init binary, on the host,
+	// for services with `init: true`.
+	InitPath string
+
+	// projectDir is where files the project refers to are read from.
+	projectDir string
+}
+
+// ParseUsernsRemap parses a HOSTID:SIZE range of host ids into the mapping
+// used for SpecOptions.UsernsRemap.
+func ParseUsernsRemap(value string) ([]specs.LinuxIDMapping, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid --userns-remap value(%s): must be HOSTID:SIZE", value)
+	}
+	hostID, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid --userns-remap host id(%s): %s", parts[0], err)
+	}
+	size, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil || size == 0 {
+		return nil, fmt.Errorf("Invalid --userns-remap size(%s)", parts[1])
+	}
+	return []specs.LinuxIDMapping{
+		{ContainerID: 0, HostID: uint32(hostID), Size: uint32(size)},
+	}, nil
+}
+
+// Where the init binary is mounted inside the container. From
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/oci_linux.go
+const inContainerInitPath = "/sbin/docker-init"
+
+// DefaultInitPath is the init binary used when one isn't configured.
+const DefaultInitPath = "/usr/bin/docker-init"
+
+// Based on the init handling of WithCommonOptions from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/oci_linux.go
+func setInit(spec *specs.Spec, svc compose.ServiceConfig, opts SpecOptions) {
+	if svc.Init == nil || !*svc.Init {
+		return
+	}
+	path := opts.InitPath
+	if len(path) == 0 {
+		path = DefaultInitPath
+	}
+	spec.Process.Args = append([]string{inContainerInitPath, "--"}, spec.Process.Args...)
+	spec.Mounts = append(spec.Mounts, specs.Mount{
+		Destination: inContainerInitPath,
+		Type:        "bind",
+		Source:      path,
+		Options:     []string{"bind", "ro"},
+	})
+}
+
+// InitBinary returns the init binary the runner has to provide for the
+// project or "" when no service needs one.
+func InitBinary(proj *compose.Project, opts SpecOptions) string {
+	for _, s := range proj.Services {
+		if s.Init != nil && *s.Init {
+			if len(opts.InitPath) == 0 {
+				return DefaultInitPath
+			}
+			return opts.InitPath
+		}
+	}
+	return ""
+}
+
+func setNamespace(s *specs.Spec, ns specs.LinuxNamespace) {
+	for i, n := range s.Linux.Namespaces {
+		if n.Type == ns.Type {
+			s.Linux.Namespaces[i] = ns
+			return
+		}
+	}
+	s.Linux.Namespaces = append(s.Linux.Namespaces, ns)
+}
+
+// sharedNamespace handles the "service:<name>" and "container:<name>"
+// modes used to join another container's namespace. The other container's
+// pid isn't known until it runs, so the path is a placeholder the runner
+// replaces with /proc/<pid>/ns/<nsType>.
+func sharedNamespace(mode, nsType string) (string, bool) {
+	parts := strings.SplitN(mode, ":", 2)
+	if len(parts) != 2 || (parts[0] != "service" && parts[0] != "container") {
+		return "", false
+	}
+	return fmt.Sprintf("{{%s:%s:%s}}", parts[0], parts[1], nsType), true
+}
+
+// Based on WithNamespaces from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/oci_linux.go
+// along with the user namespace checks from daemon_unix.go
+func setNamespaces(spec *specs.Spec, svc compose.ServiceConfig, opts SpecOptions) error {
+	userNS := false
+	// user
+	switch svc.UserNSMode {
+	case "host":
+	case "":
+		if len(opts.UsernsRemap) > 0 {
+			if svc.Privileged {
+				return errors.New("privileged mode is incompatible with user namespaces. Use 'userns_mode: host' when running privileged")
+			}
+			if svc.NetworkMode == "host" {
+				return errors.New("Cannot share the host's network namespace when user namespaces are enabled")
+			}
+			if svc.Pid == "host" {
+				return errors.New("Cannot share the host PID namespace when user namespaces are enabled")
+			}
+			userNS = true
+			setNamespace(spec, specs.LinuxNamespace{Type: specs.UserNamespace})
+			spec.Linux.UIDMappings = opts.UsernsRemap
+			spec.Linux.GIDMappings = opts.UsernsRemap
+		}
+	default:
+		return fmt.Errorf("Invalid userns_mode: %s", svc.UserNSMode)
+	}
+
+	// joinUserNS makes sure a container joining another's namespace shares
+	// its user namespace as well.
+	joinUserNS := func(mode string) {
+		if userNS {
+			path, _ := sharedNamespace(mode, "user")
+			setNamespace(spec, specs.LinuxNamespace{Type: specs.UserNamespace, Path: path})
+		}
+	}
+
+	// network
+	switch svc.NetworkMode {
+	case "host":
+		oci.RemoveNamespace(spec, specs.NetworkNamespace)
+	case "", "none", "bridge", "default":
+		setNamespace(spec, specs.LinuxNamespace{Type: specs.NetworkNamespace})
+	default:
+		path, ok := sharedNamespace(svc.NetworkMode, "net")
+		if !ok {
+			return fmt.Errorf("Unsupported network_mode: %s", svc.NetworkMode)
+		}
+		setNamespace(spec, specs.LinuxNamespace{Type: specs.NetworkNamespace, Path: path})
+		joinUserNS(svc.NetworkMode)
+	}
+
+	// ipc
+	switch svc.Ipc {
+	case "host":
+		oci.RemoveNamespace(spec, specs.IPCNamespace)
+	case "", "private", "shareable", "none":
+		setNamespace(spec, specs.LinuxNamespace{Type: specs.IPCNamespace})
+	default:
+		path, ok := sharedNamespace(svc.Ipc, "ipc")
+		if !ok {
+			return fmt.Errorf("Invalid ipc mode: %s", svc.Ipc)
+		}
+		setNamespace(spec, specs.LinuxNamespace{Type: specs.IPCNamespace, Path: path})
+		joinUserNS(svc.Ipc)
+	}
+
+	// pid
+	switch svc.Pid {
+	case "host":
+		oci.RemoveNamespace(spec, specs.PIDNamespace)
+	case "":
+		setNamespace(spec, specs.LinuxNamespace{Type: specs.PIDNamespace})
+	default:
+		path, ok := sharedNamespace(svc.Pid, "pid")
+		if !ok {
+			return fmt.Errorf("Invalid pid mode: %s", svc.Pid)
+		}
+		setNamespace(spec, specs.LinuxNamespace{Type: specs.PIDNamespace, Path: path})
+		joinUserNS(svc.Pid)
+	}
+
+	// uts
+	if svc.Uts == "host" {
+		oci.RemoveNamespace(spec, specs.UTSNamespace)
+		spec.Hostname = ""
+	}
+	return nil
+}
+
 func setLabels(spec *specs.Spec, svc compose.ServiceConfig, c container.Config) {
 	spec.Annotations = c.Labels
 	if spec.Annotations == nil {
@@ -173,10 +527,118 @@ func setLabels(spec *specs.Spec, svc compose.ServiceConfig, c container.Config)
 	}
 }
 
+// setStop records how the container should be stopped so the runner can
+// do it the way Docker would.
+func setStop(spec *specs.Spec, svc compose.ServiceConfig, c container.Config) error {
+	stop, err := stopConfig(svc, c)
+	if err != nil {
+		return err
+	}
+	if spec.Annotations == nil {
+		spec.Annotations = make(map[string]string)
+	}
+	spec.Annotations["compose-app-stop-signal"] = stop.Signal
+	spec.Annotations["compose-app-stop-grace-period"] = stop.GracePeriod.String()
+	return nil
+}
+
+// From
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/config/config_unix.go
+const defaultShmSize = int64(64 * 1024 * 1024)
+
+// Based on setupIpcDirs from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/container_operations_unix.go
+// and the /dev/shm handling of WithMounts from oci_linux.go. A container
+// joining another's ipc namespace gets that container's /dev/shm. Its path
+// is a placeholder the runner replaces with /proc/<pid>/root/dev/shm.
+func setShm(spec *specs.Spec, svc compose.ServiceConfig) error {
+	shmSize := defaultShmSize
+	if len(svc.ShmSize) > 0 {
+		size, err := units.RAMInBytes(svc.ShmSize)
+		if err != nil {
+			return fmt.Errorf("Invalid shm_size(%s): %s", svc.ShmSize, err)
+		}
+		if size <= 0 {
+			return fmt.Errorf("Invalid shm_size(%s): must be greater than 0", svc.ShmSize)
+		}
+		shmSize = size
+	}
+
+	var shm *specs.Mount
+	switch svc.Ipc {
+	case "none":
+	case "", "private", "shareable":
+		shm = &specs.Mount{
+			Destination: "/dev/shm",
+			Type:        "tmpfs",
+			Source:      "shm",
+			Options:     []string{"nosuid", "noexec", "nodev", "mode=1777", "size=" + strconv.FormatInt(shmSize, 10)},
+		}
+	case "host":
+		shm = &specs.Mount{
+			Destination: "/dev/shm",
+			Type:        "bind",
+			Source:      "/dev/shm",
+			Options:     []string{"rbind", "rprivate", "rw"},
+		}
+	default:
+		path, ok := sharedNamespace(svc.Ipc, "shm")
+		if !ok {
+			return fmt.Errorf("Invalid ipc mode: %s", svc.Ipc)
+		}
+		shm = &specs.Mount{
+			Destination: "/dev/shm",
+			Type:        "bind",
+			Source:      path,
+			Options:     []string{"rbind", "rprivate", "rw"},
+		}
+	}
+
+	// Volumes mounted over /dev/shm take its place
+	for _, v := range svc.Volumes {
+		if v.Target == "/dev/shm" {
+			shm = nil
+		}
+	}
+	for _, tfs := range svc.Tmpfs {
+		if tfs == "/dev/shm" {
+			shm = nil
+		}
+	}
+
+	mounts := spec.Mounts[:0]
+	for _, m := range spec.Mounts {
+		if m.Destination != "/dev/shm" {
+			mounts = append(mounts, m)
+		} else if shm != nil {
+			mounts = append(mounts, *shm)
+		}
+	}
+	spec.Mounts = mounts
+	return nil
+}
+
+// checkIpcModes makes sure services only join the ipc namespace of services
+// that share it.
+func checkIpcModes(proj *compose.Project) error {
+	for _, s := range proj.Services {
+		if !strings.HasPrefix(s.Ipc, "service:") {
+			continue
+		}
+		name := s.Ipc[8:]
+		donor, err := proj.GetService(name)
+		if err != nil {
+			return fmt.Errorf("Service(%s): ipc service %s not found", s.Name, name)
+		}
+		if donor.Ipc != "shareable" && donor.Ipc != "host" {
+			return fmt.Errorf("Service(%s): cannot join non-shareable ipc of service %s (hint: use 'ipc: shareable' for it)", s.Name, name)
+		}
+	}
+	return nil
+}
+
 func setMounts(spec *specs.Spec, svc compose.ServiceConfig) {
-	// TODO lots of WithMounts is missing here like ipc mode shm-size
-	// and docker-compose volumes
-	// also missing volumes-from
+	// TODO missing volumes-from
 	for _, v := range svc.Volumes {
 		mode := "rw"
 		if v.ReadOnly {
@@ -186,14 +648,23 @@ func setMounts(spec *specs.Spec, svc compose.ServiceConfig) {
 		if v.Bind != nil {
 			options[0] = v.Bind.Propagation
 		}
+		mountType := v.Type
 		source := v.Source
 		if v.Type == "tmpfs" {
 			source = "tmpfs"
 			options = []string{"noexec", "nosuid", "nodev", "rprivate"}
+		} else if v.Type == "volume" {
+			// Volumes are directories the runner manages on the host
+			mountType = "bind"
+			name := v.Source
+			if len(name) == 0 {
+				name = anonymousVolume(svc.Name, v.Target)
+			}
+			source = volumeSource(name)
 		}
 		spec.Mounts = append(spec.Mounts, specs.Mount{
 			Destination: v.Target,
-			Type:        v.Type,
+			Type:        mountType,
 			Source:      source,
 			Options:     options,
 		})
@@ -209,11 +680,11 @@ func setMounts(spec *specs.Spec, svc compose.ServiceConfig) {
 	}
 }
 
-func RuncSpec(s compose.ServiceConfig, containerConfigBytes []byte) ([]byte, error) {
+func RuncSpec(s compose.ServiceConfig, cc ContainerConfig, opts SpecOptions) ([]byte, error) {
 	var fullconfig struct {
 		Config container.Config `json:"config"`
 	}
-	if err := json.Unmarshal(containerConfigBytes, &fullconfig); err != nil {
+	if err := json.Unmarshal(cc.Config, &fullconfig); err != nil {
 		return nil, err
 	}
 	containerConfig := fullconfig.Config
@@ -221,29 +692,53 @@ func RuncSpec(s compose.ServiceConfig, containerConfigBytes []byte) ([]byte, err
 	spec := oci.DefaultSpec()
 
 	setLabels(&spec, s, containerConfig)
+	if err := setStop(&spec, s, containerConfig); err != nil {
+		return nil, err
+	}
 	if err := setCommonOptions(&spec, s, containerConfig); err != nil {
 		return nil, err
 	}
+	setInit(&spec, s, opts)
 	setSysctls(&spec, s, containerConfig)
+	if err := setUser(&spec, s, containerConfig, cc.Passwd, cc.Group); err != nil {
+		return nil, err
+	}
 	if err := setCapabilities(&spec, s, containerConfig); err != nil {
 		return nil, err
 	}
+	platform, err := configPlatform(cc.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSeccomp(&spec, s, platform, opts.projectDir); err != nil {
+		return nil, err
+	}
+	if err := setResources(&spec, s); err != nil {
+		return nil, err
+	}
+	if err := setRlimits(&spec, s); err != nil {
+		return nil, err
+	}
+	if err := setDevices(&spec, s); err != nil {
+		return nil, err
+	}
+	if err := setNamespaces(&spec, s, opts); err != nil {
+		return nil, err
+	}
+	if err := setShm(&spec, s); err != nil {
+		return nil, err
+	}
 	setMounts(&spec, s)
+	setImageVolumes(&spec, s, containerConfig)
+	setFileMounts(&spec, s)
 	setOOMScore(&spec, s, containerConfig)
 	/* TODO port these oci_linux.go functions where applicable:
 	opts = append(opts,
 		WithCgroups(daemon, c),
-		WithResources(c),
-		WithDevices(daemon, c),
-		WithRlimits(daemon, c),
-		WithNamespaces(daemon, c),
 		WithLibnetwork(daemon, c),
 		WithApparmor(c),
 		WithSelinux(c),
 	)
-	if c.NoNewPrivileges {
-		opts = append(opts, coci.WithNoNewPrivileges)
-	}
 	*/
 
 	return json.MarshalIndent(spec, "", "  ")
@@ -260,15 +755,6 @@ func isSupported(proj *compose.Project) error {
 		if s.CPUPercent > 0 {
 			return fmt.Errorf("Unsupported attribute 'cpu_percent': %f", s.CPUPercent)
 		}
-		if s.CPUShares > 0 {
-			return fmt.Errorf("Unsupported attribute 'cpu_shares': %d", s.CPUShares)
-		}
-		if s.CPUPeriod > 0 {
-			return fmt.Errorf("Unsupported attribute 'cpu_period': %d", s.CPUPeriod)
-		}
-		if s.CPUQuota > 0 {
-			return fmt.Errorf("Unsupported attribute 'cpu_quota': %d", s.CPUQuota)
-		}
 		if s.CPURTRuntime > 0 {
 			return fmt.Errorf("Unsupported attribute 'cpu_rt_runtime': %d", s.CPURTRuntime)
 		}
@@ -278,36 +764,21 @@ func isSupported(proj *compose.Project) error {
 		if s.CPUS > 0 {
 			return fmt.Errorf("Unsupported/deprecated attribute 'cpus': %f", s.CPUS)
 		}
-		if len(s.CPUSet) > 0 {
-			return fmt.Errorf("Unsupported attribute 'cpu_set': %s", s.CPUSet)
-		}
 		if s.Build != nil {
 			return fmt.Errorf("Unsupported attribute 'build'")
 		}
 		if len(s.CgroupParent) > 0 {
 			return fmt.Errorf("Unsupported attribute 'cgroup_parent': %s", s.CgroupParent)
 		}
-		if s.Configs != nil {
-			return fmt.Errorf("Unsupported attribute 'configs'")
-		}
 		if len(s.ContainerName) > 0 {
 			return fmt.Errorf("Unsupported attribute 'container_name': %s", s.ContainerName)
 		}
 		if s.CredentialSpec != nil {
 			return fmt.Errorf("Unsupported attribute 'credential_spec'")
 		}
-		if s.DependsOn != nil {
-			return fmt.Errorf("Unsupported attribute 'depends_on'")
-		}
 		if s.Deploy != nil {
 			return fmt.Errorf("Unsupported swarm attribute 'deploy'")
 		}
-		if s.Devices != nil {
-			return fmt.Errorf("Unsupported attribute 'devices'")
-		}
-		if s.EnvFile != nil {
-			return fmt.Errorf("Unsupported attribute 'env_file'")
-		}
 		if s.Expose != nil {
 			return fmt.Errorf("Unsupported attribute 'expose' (not required)")
 		}
@@ -320,15 +791,6 @@ func isSupported(proj *compose.Project) error {
 		if s.GroupAdd != nil {
 			return fmt.Errorf("Unsupported attribute 'group_add'")
 		}
-		if s.HealthCheck != nil {
-			return fmt.Errorf("Unsupported attribute 'healthcheck'")
-		}
-		if s.Init != nil && *s.Init {
-			return fmt.Errorf("Unsupported attribute 'init'")
-		}
-		if len(s.Ipc) > 0 {
-			return fmt.Errorf("Unsupported attribute 'ipc': %s", s.Ipc)
-		}
 		if len(s.Isolation) > 0 {
 			return fmt.Errorf("Unsupported attribute 'isolation': %s", s.Isolation)
 		}
@@ -341,24 +803,6 @@ func isSupported(proj *compose.Project) error {
 		if len(s.MacAddress) > 0 {
 			return fmt.Errorf("Unsupported attribute 'mac_address': %s", s.MacAddress)
 		}
-		if s.MemLimit > 0 {
-			return fmt.Errorf("Unsupported/deprecated attribute 'mem_limit': %d", s.MemLimit)
-		}
-		if s.MemReservation > 0 {
-			return fmt.Errorf("Unsupported/deprecated attribute 'mem_reservation': %d", s.MemReservation)
-		}
-		if s.MemSwappiness > 0 {
-			return fmt.Errorf("Unsupported attribute 'mem_swapiness': %d", s.MemSwappiness)
-		}
-		if s.MemSwapLimit > 0 {
-			return fmt.Errorf("Unsupported attribute 'memswap_limit': %d", s.MemSwapLimit)
-		}
-		if len(s.Pid) > 0 {
-			return fmt.Errorf("Unsupported attribute 'pid': %s", s.Isolation)
-		}
-		if s.PidLimit > 0 {
-			return fmt.Errorf("Unsupported attribute 'pids_limit': %d", s.PidLimit)
-		}
 		if len(s.Platform) > 0 {
 			return fmt.Errorf("Unsupported attribute 'platform': %s", s.Platform)
 		}
@@ -368,27 +812,9 @@ func isSupported(proj *compose.Project) error {
 		if s.Scale > 0 {
 			return fmt.Errorf("Unsupported swarm attribute 'scale': %d", s.Scale)
 		}
-		if s.Secrets != nil {
-			return fmt.Errorf("Unsupported attribute 'secrets'")
-		}
-		if len(s.ShmSize) > 0 {
-			return fmt.Errorf("Unsupported attribute 'shm_size': %s", s.ShmSize)
-		}
 		if s.StdinOpen {
 			return fmt.Errorf("Unsupported attribute 'stdin_open: true'")
 		}
-		if s.StopGracePeriod != nil {
-			return fmt.Errorf("Unsupported attribute 'stop_grace_period'")
-		}
-		if len(s.StopSignal) > 0 {
-			return fmt.Errorf("Unsupported attribute 'stop_signal': %s", s.StopSignal)
-		}
-		if s.Ulimits != nil {
-			return fmt.Errorf("Unsupported attribute 'ulimits'")
-		}
-		if len(s.UserNSMode) > 0 {
-			return fmt.Errorf("Unsupported attribute 'userns_mode': %s", s.UserNSMode)
-		}
 		if s.VolumesFrom != nil {
 			return fmt.Errorf("Unsupported attribute 'volumes_from'")
 		}
@@ -396,16 +822,22 @@ func isSupported(proj *compose.Project) error {
 	})
 }
 
-func CreateSpecs(proj *compose.Project, configs ServiceConfigs) (map[string][]byte, error) {
+func CreateSpecs(proj *compose.Project, configs ServiceConfigs, opts SpecOptions) (map[string][]byte, error) {
 	if err := isSupported(proj); err != nil {
 		return nil, err
 	}
+	if err := checkIpcModes(proj); err != nil {
+		return nil, err
+	}
 	specs := make(map[string][]byte)
+	// Each spec carries its own seccomp profile now. The default profile is
+	// still written for runners that load it themselves.
 	bytes, err := json.MarshalIndent(seccomp.DefaultProfile(), "", "  ")
 	if err != nil {
 		return nil, err
 	}
 	specs[".default-secomp.json"] = bytes
+	opts.projectDir = proj.WorkingDir
 	return specs, proj.WithServices(nil, func(s compose.ServiceConfig) error {
 		for _, containerConfig := range configs[s.Name] {
 			fname := s.Name + "/"
@@ -414,9 +846,9 @@ func CreateSpecs(proj *compose.Project, configs ServiceConfigs) (map[string][]by
 			} else {
 				fname += containerConfig.Platform
 			}
-			spec, err := RuncSpec(s, containerConfig.Config)
+			spec, err := RuncSpec(s, containerConfig, opts)
 			if err != nil {
-				return err
+				return fmt.Errorf("Service(%s): %s", s.Name, err)
 			}
 			specs[fname] = spec
 		}
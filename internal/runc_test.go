@@ -0,0 +1,813 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	compose "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/profiles/seccomp"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func int64p(v int64) *int64    { return &v }
+func uint64p(v uint64) *uint64 { return &v }
+func boolp(v bool) *bool       { return &v }
+
+// asJSON makes failures readable as the resources are mostly pointers.
+func asJSON(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestSetResources(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		name   string
+		svc    compose.ServiceConfig
+		memory specs.LinuxMemory
+		cpu    specs.LinuxCPU
+		pids   *specs.LinuxPids
+		err    string
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:   "mem_limit gets as much swap again",
+			svc:    compose.ServiceConfig{MemLimit: 64 * mb},
+			memory: specs.LinuxMemory{Limit: int64p(64 * mb), Swap: int64p(128 * mb)},
+		},
+		{
+			name: "mem_limit too small",
+			svc:  compose.ServiceConfig{MemLimit: 1 * mb},
+			err:  "Minimum memory limit allowed is 4MB",
+		},
+		{
+			name:   "memswap_limit",
+			svc:    compose.ServiceConfig{MemLimit: 64 * mb, MemSwapLimit: 96 * mb},
+			memory: specs.LinuxMemory{Limit: int64p(64 * mb), Swap: int64p(96 * mb)},
+		},
+		{
+			name:   "unlimited memswap_limit",
+			svc:    compose.ServiceConfig{MemLimit: 64 * mb, MemSwapLimit: -1},
+			memory: specs.LinuxMemory{Limit: int64p(64 * mb), Swap: int64p(-1)},
+		},
+		{
+			name: "memswap_limit without mem_limit",
+			svc:  compose.ServiceConfig{MemSwapLimit: 96 * mb},
+			err:  "mem_limit must be set when using memswap_limit",
+		},
+		{
+			name: "memswap_limit below mem_limit",
+			svc:  compose.ServiceConfig{MemLimit: 64 * mb, MemSwapLimit: 32 * mb},
+			err:  "memswap_limit must be larger than mem_limit",
+		},
+		{
+			name:   "mem_reservation",
+			svc:    compose.ServiceConfig{MemReservation: 32 * mb},
+			memory: specs.LinuxMemory{Reservation: int64p(32 * mb)},
+		},
+		{
+			name: "mem_reservation too small",
+			svc:  compose.ServiceConfig{MemReservation: 1 * mb},
+			err:  "Minimum memory reservation allowed is 4MB",
+		},
+		{
+			name: "mem_reservation above mem_limit",
+			svc:  compose.ServiceConfig{MemLimit: 32 * mb, MemReservation: 64 * mb},
+			err:  "mem_limit can not be less than mem_reservation",
+		},
+		{
+			name:   "mem_swappiness",
+			svc:    compose.ServiceConfig{MemSwappiness: 60},
+			memory: specs.LinuxMemory{Swappiness: uint64p(60)},
+		},
+		{
+			name: "mem_swappiness of 0",
+			svc: compose.ServiceConfig{
+				Extensions: map[string]interface{}{MemSwappinessExtension: int64(0)},
+			},
+			memory: specs.LinuxMemory{Swappiness: uint64p(0)},
+		},
+		{
+			name: "mem_swappiness of -1 is unset",
+			svc: compose.ServiceConfig{
+				MemSwappiness: -1,
+				Extensions:    map[string]interface{}{MemSwappinessExtension: int64(-1)},
+			},
+		},
+		{
+			name: "mem_swappiness too large",
+			svc:  compose.ServiceConfig{MemSwappiness: 101},
+			err:  "Invalid mem_swappiness: 101, valid range is 0-100",
+		},
+		{
+			name:   "oom_kill_disable",
+			svc:    compose.ServiceConfig{OomKillDisable: true},
+			memory: specs.LinuxMemory{DisableOOMKiller: boolp(true)},
+		},
+		{
+			name: "cpu_shares",
+			svc:  compose.ServiceConfig{CPUShares: 512},
+			cpu:  specs.LinuxCPU{Shares: uint64p(512)},
+		},
+		{
+			name: "cpuset",
+			svc:  compose.ServiceConfig{CPUSet: "0-1"},
+			cpu:  specs.LinuxCPU{Cpus: "0-1"},
+		},
+		{
+			name: "cpu_period and cpu_quota",
+			svc:  compose.ServiceConfig{CPUPeriod: 100000, CPUQuota: 50000},
+			cpu:  specs.LinuxCPU{Period: uint64p(100000), Quota: int64p(50000)},
+		},
+		{
+			name: "cpu_period too small",
+			svc:  compose.ServiceConfig{CPUPeriod: 999},
+			err:  "cpu_period can not be less than 1ms (i.e. 1000) or larger than 1s (i.e. 1000000)",
+		},
+		{
+			name: "cpu_period too large",
+			svc:  compose.ServiceConfig{CPUPeriod: 1000001},
+			err:  "cpu_period can not be less than 1ms (i.e. 1000) or larger than 1s (i.e. 1000000)",
+		},
+		{
+			name: "cpu_quota too small",
+			svc:  compose.ServiceConfig{CPUQuota: 999},
+			err:  "cpu_quota can not be less than 1ms (i.e. 1000)",
+		},
+		{
+			name: "pids_limit",
+			svc:  compose.ServiceConfig{PidLimit: 100},
+			pids: &specs.LinuxPids{Limit: 100},
+		},
+		{
+			name: "unlimited pids_limit",
+			svc:  compose.ServiceConfig{PidLimit: -5},
+			pids: &specs.LinuxPids{Limit: -1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{}}}
+			err := setResources(&spec, tt.svc)
+			if len(tt.err) > 0 {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			res := spec.Linux.Resources
+			if asJSON(res.Memory) != asJSON(tt.memory) {
+				t.Errorf("memory: got %s, expected %s", asJSON(res.Memory), asJSON(tt.memory))
+			}
+			if asJSON(res.CPU) != asJSON(tt.cpu) {
+				t.Errorf("cpu: got %s, expected %s", asJSON(res.CPU), asJSON(tt.cpu))
+			}
+			if asJSON(res.Pids) != asJSON(tt.pids) {
+				t.Errorf("pids: got %s, expected %s", asJSON(res.Pids), asJSON(tt.pids))
+			}
+		})
+	}
+}
+
+func TestSetRlimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		ulimits map[string]*compose.UlimitsConfig
+		rlimits []specs.POSIXRlimit
+		err     string
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:    "single value",
+			ulimits: map[string]*compose.UlimitsConfig{"nproc": {Single: 65535}},
+			rlimits: []specs.POSIXRlimit{{Type: "RLIMIT_NPROC", Soft: 65535, Hard: 65535}},
+		},
+		{
+			name:    "soft and hard",
+			ulimits: map[string]*compose.UlimitsConfig{"nofile": {Soft: 20000, Hard: 40000}},
+			rlimits: []specs.POSIXRlimit{{Type: "RLIMIT_NOFILE", Soft: 20000, Hard: 40000}},
+		},
+		{
+			name: "sorted by name",
+			ulimits: map[string]*compose.UlimitsConfig{
+				"nproc":   {Single: 100},
+				"core":    {Single: 0},
+				"memlock": {Soft: -1, Hard: -1},
+			},
+			rlimits: []specs.POSIXRlimit{
+				{Type: "RLIMIT_CORE", Soft: 0, Hard: 0},
+				{Type: "RLIMIT_MEMLOCK", Soft: 18446744073709551615, Hard: 18446744073709551615},
+				{Type: "RLIMIT_NPROC", Soft: 100, Hard: 100},
+			},
+		},
+		{
+			name:    "unknown name",
+			ulimits: map[string]*compose.UlimitsConfig{"files": {Single: 100}},
+			err:     "Invalid ulimit(files): invalid ulimit type: files",
+		},
+		{
+			name:    "soft above hard",
+			ulimits: map[string]*compose.UlimitsConfig{"nofile": {Soft: 40000, Hard: 20000}},
+			err:     "Invalid ulimit(nofile): ulimit soft limit must be less than or equal to hard limit: 40000 > 20000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := specs.Spec{Process: &specs.Process{}}
+			err := setRlimits(&spec, compose.ServiceConfig{Ulimits: tt.ulimits})
+			if len(tt.err) > 0 {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if asJSON(spec.Process.Rlimits) != asJSON(tt.rlimits) {
+				t.Errorf("got %s, expected %s", asJSON(spec.Process.Rlimits), asJSON(tt.rlimits))
+			}
+		})
+	}
+}
+
+var testImageConfig = ContainerConfig{
+	Platform: "amd64",
+	Config:   []byte(`{"architecture":"amd64","os":"linux","config":{"Cmd":["/bin/sh"]}}`),
+}
+
+func testSpec(t *testing.T, svc compose.ServiceConfig) specs.Spec {
+	t.Helper()
+	content, err := RuncSpec(svc, testImageConfig, SpecOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec specs.Spec
+	if err := json.Unmarshal(content, &spec); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func TestInit(t *testing.T) {
+	initMount := func(source string) []specs.Mount {
+		return []specs.Mount{{
+			Destination: "/sbin/docker-init",
+			Type:        "bind",
+			Source:      source,
+			Options:     []string{"bind", "ro"},
+		}}
+	}
+	tests := []struct {
+		name   string
+		init   *bool
+		opts   SpecOptions
+		args   []string
+		mounts []specs.Mount
+		binary string
+	}{
+		{
+			name: "unset",
+			args: []string{"/bin/sh"},
+		},
+		{
+			name: "init: false",
+			init: boolp(false),
+			args: []string{"/bin/sh"},
+		},
+		{
+			name:   "init: true",
+			init:   boolp(true),
+			args:   []string{"/sbin/docker-init", "--", "/bin/sh"},
+			mounts: initMount("/usr/bin/docker-init"),
+			binary: "/usr/bin/docker-init",
+		},
+		{
+			name:   "--init-path",
+			init:   boolp(true),
+			opts:   SpecOptions{InitPath: "/usr/libexec/tini"},
+			args:   []string{"/sbin/docker-init", "--", "/bin/sh"},
+			mounts: initMount("/usr/libexec/tini"),
+			binary: "/usr/libexec/tini",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := compose.ServiceConfig{Name: "app", Init: tt.init}
+			content, err := RuncSpec(svc, testImageConfig, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var spec specs.Spec
+			if err := json.Unmarshal(content, &spec); err != nil {
+				t.Fatal(err)
+			}
+			if asJSON(spec.Process.Args) != asJSON(tt.args) {
+				t.Errorf("args: got %s, expected %s", asJSON(spec.Process.Args), asJSON(tt.args))
+			}
+			var mounts []specs.Mount
+			for _, m := range spec.Mounts {
+				if m.Destination == "/sbin/docker-init" {
+					mounts = append(mounts, m)
+				}
+			}
+			if asJSON(mounts) != asJSON(tt.mounts) {
+				t.Errorf("mounts: got %s, expected %s", asJSON(mounts), asJSON(tt.mounts))
+			}
+
+			proj := &compose.Project{Services: compose.Services{{Name: "other"}, svc}}
+			if binary := InitBinary(proj, tt.opts); binary != tt.binary {
+				t.Errorf("init binary: got %q, expected %q", binary, tt.binary)
+			}
+		})
+	}
+}
+
+func TestIpcModes(t *testing.T) {
+	tmpfsShm := func(size string) *specs.Mount {
+		return &specs.Mount{
+			Destination: "/dev/shm",
+			Type:        "tmpfs",
+			Source:      "shm",
+			Options:     []string{"nosuid", "noexec", "nodev", "mode=1777", "size=" + size},
+		}
+	}
+	bindShm := func(source string) *specs.Mount {
+		return &specs.Mount{
+			Destination: "/dev/shm",
+			Type:        "bind",
+			Source:      source,
+			Options:     []string{"rbind", "rprivate", "rw"},
+		}
+	}
+	private := &specs.LinuxNamespace{Type: specs.IPCNamespace}
+
+	tests := []struct {
+		name string
+		svc  compose.ServiceConfig
+		ns   *specs.LinuxNamespace
+		shm  *specs.Mount
+	}{
+		{
+			name: "default",
+			ns:   private,
+			shm:  tmpfsShm("67108864"),
+		},
+		{
+			name: "private",
+			svc:  compose.ServiceConfig{Ipc: "private"},
+			ns:   private,
+			shm:  tmpfsShm("67108864"),
+		},
+		{
+			name: "shareable",
+			svc:  compose.ServiceConfig{Ipc: "shareable"},
+			ns:   private,
+			shm:  tmpfsShm("67108864"),
+		},
+		{
+			name: "shm_size",
+			svc:  compose.ServiceConfig{Ipc: "shareable", ShmSize: "256M"},
+			ns:   private,
+			shm:  tmpfsShm("268435456"),
+		},
+		{
+			name: "host",
+			svc:  compose.ServiceConfig{Ipc: "host"},
+			shm:  bindShm("/dev/shm"),
+		},
+		{
+			name: "none",
+			svc:  compose.ServiceConfig{Ipc: "none"},
+			ns:   private,
+		},
+		{
+			name: "service",
+			svc:  compose.ServiceConfig{Ipc: "service:db"},
+			ns:   &specs.LinuxNamespace{Type: specs.IPCNamespace, Path: "{{service:db:ipc}}"},
+			shm:  bindShm("{{service:db:shm}}"),
+		},
+		{
+			name: "container",
+			svc:  compose.ServiceConfig{Ipc: "container:db"},
+			ns:   &specs.LinuxNamespace{Type: specs.IPCNamespace, Path: "{{container:db:ipc}}"},
+			shm:  bindShm("{{container:db:shm}}"),
+		},
+		{
+			name: "tmpfs over /dev/shm",
+			svc:  compose.ServiceConfig{Ipc: "shareable", Tmpfs: compose.StringList{"/dev/shm"}},
+			ns:   private,
+			shm: &specs.Mount{
+				Destination: "/dev/shm",
+				Type:        "tmpfs",
+				Source:      "tmpfs",
+				Options:     []string{"nosuid", "noexec", "nodev"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.svc.Name = "app"
+			spec := testSpec(t, tt.svc)
+
+			var ns *specs.LinuxNamespace
+			for i, n := range spec.Linux.Namespaces {
+				if n.Type == specs.IPCNamespace {
+					ns = &spec.Linux.Namespaces[i]
+				}
+			}
+			if asJSON(ns) != asJSON(tt.ns) {
+				t.Errorf("ipc namespace: got %s, expected %s", asJSON(ns), asJSON(tt.ns))
+			}
+
+			var shm []specs.Mount
+			for _, m := range spec.Mounts {
+				if m.Destination == "/dev/shm" {
+					shm = append(shm, m)
+				}
+			}
+			var expected []specs.Mount
+			if tt.shm != nil {
+				expected = append(expected, *tt.shm)
+			}
+			if asJSON(shm) != asJSON(expected) {
+				t.Errorf("/dev/shm: got %s, expected %s", asJSON(shm), asJSON(expected))
+			}
+		})
+	}
+}
+
+// namespace returns the spec's namespace of the given type, if it has one.
+func namespace(spec specs.Spec, nsType specs.LinuxNamespaceType) *specs.LinuxNamespace {
+	for i, n := range spec.Linux.Namespaces {
+		if n.Type == nsType {
+			return &spec.Linux.Namespaces[i]
+		}
+	}
+	return nil
+}
+
+func TestNamespaces(t *testing.T) {
+	remap := []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	tests := []struct {
+		name     string
+		svc      compose.ServiceConfig
+		opts     SpecOptions
+		ns       map[specs.LinuxNamespaceType]*specs.LinuxNamespace
+		mappings []specs.LinuxIDMapping
+	}{
+		{
+			name: "default",
+			ns: map[specs.LinuxNamespaceType]*specs.LinuxNamespace{
+				specs.NetworkNamespace: {Type: specs.NetworkNamespace},
+				specs.PIDNamespace:     {Type: specs.PIDNamespace},
+				specs.UTSNamespace:     {Type: specs.UTSNamespace},
+				specs.UserNamespace:    nil,
+			},
+		},
+		{
+			name: "host",
+			svc:  compose.ServiceConfig{NetworkMode: "host", Pid: "host", Uts: "host"},
+			ns: map[specs.LinuxNamespaceType]*specs.LinuxNamespace{
+				specs.NetworkNamespace: nil,
+				specs.PIDNamespace:     nil,
+				specs.UTSNamespace:     nil,
+			},
+		},
+		{
+			name: "service",
+			svc:  compose.ServiceConfig{NetworkMode: "service:db", Pid: "service:db"},
+			ns: map[specs.LinuxNamespaceType]*specs.LinuxNamespace{
+				specs.NetworkNamespace: {Type: specs.NetworkNamespace, Path: "{{service:db:net}}"},
+				specs.PIDNamespace:     {Type: specs.PIDNamespace, Path: "{{service:db:pid}}"},
+				specs.UserNamespace:    nil,
+			},
+		},
+		{
+			name: "container",
+			svc:  compose.ServiceConfig{NetworkMode: "container:db", Pid: "container:web"},
+			ns: map[specs.LinuxNamespaceType]*specs.LinuxNamespace{
+				specs.NetworkNamespace: {Type: specs.NetworkNamespace, Path: "{{container:db:net}}"},
+				specs.PIDNamespace:     {Type: specs.PIDNamespace, Path: "{{container:web:pid}}"},
+			},
+		},
+		{
+			name: "userns remap",
+			opts: SpecOptions{UsernsRemap: remap},
+			ns: map[specs.LinuxNamespaceType]*specs.LinuxNamespace{
+				specs.UserNamespace: {Type: specs.UserNamespace},
+			},
+			mappings: remap,
+		},
+		{
+			name: "userns remap joining a service",
+			svc:  compose.ServiceConfig{NetworkMode: "service:db"},
+			opts: SpecOptions{UsernsRemap: remap},
+			ns: map[specs.LinuxNamespaceType]*specs.LinuxNamespace{
+				specs.NetworkNamespace: {Type: specs.NetworkNamespace, Path: "{{service:db:net}}"},
+				specs.UserNamespace:    {Type: specs.UserNamespace, Path: "{{service:db:user}}"},
+			},
+			mappings: remap,
+		},
+		{
+			name: "userns_mode: host",
+			svc:  compose.ServiceConfig{UserNSMode: "host", Privileged: true},
+			opts: SpecOptions{UsernsRemap: remap},
+			ns: map[specs.LinuxNamespaceType]*specs.LinuxNamespace{
+				specs.UserNamespace: nil,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.svc.Name = "app"
+			content, err := RuncSpec(tt.svc, testImageConfig, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var spec specs.Spec
+			if err := json.Unmarshal(content, &spec); err != nil {
+				t.Fatal(err)
+			}
+			for nsType, expected := range tt.ns {
+				if ns := namespace(spec, nsType); asJSON(ns) != asJSON(expected) {
+					t.Errorf("%s namespace: got %s, expected %s", nsType, asJSON(ns), asJSON(expected))
+				}
+			}
+			if asJSON(spec.Linux.UIDMappings) != asJSON(tt.mappings) {
+				t.Errorf("uid mappings: got %s, expected %s", asJSON(spec.Linux.UIDMappings), asJSON(tt.mappings))
+			}
+			if asJSON(spec.Linux.GIDMappings) != asJSON(tt.mappings) {
+				t.Errorf("gid mappings: got %s, expected %s", asJSON(spec.Linux.GIDMappings), asJSON(tt.mappings))
+			}
+		})
+	}
+}
+
+func TestNamespaceErrors(t *testing.T) {
+	remap := SpecOptions{UsernsRemap: []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}}
+	tests := []struct {
+		svc  compose.ServiceConfig
+		opts SpecOptions
+		err  string
+	}{
+		{
+			svc: compose.ServiceConfig{NetworkMode: "bogus"},
+			err: "Unsupported network_mode: bogus",
+		},
+		{
+			svc: compose.ServiceConfig{Pid: "bogus"},
+			err: "Invalid pid mode: bogus",
+		},
+		{
+			svc: compose.ServiceConfig{UserNSMode: "bogus"},
+			err: "Invalid userns_mode: bogus",
+		},
+		{
+			svc:  compose.ServiceConfig{Privileged: true},
+			opts: remap,
+			err:  "privileged mode is incompatible with user namespaces. Use 'userns_mode: host' when running privileged",
+		},
+		{
+			svc:  compose.ServiceConfig{NetworkMode: "host"},
+			opts: remap,
+			err:  "Cannot share the host's network namespace when user namespaces are enabled",
+		},
+		{
+			svc:  compose.ServiceConfig{Pid: "host"},
+			opts: remap,
+			err:  "Cannot share the host PID namespace when user namespaces are enabled",
+		},
+	}
+	for _, tt := range tests {
+		tt.svc.Name = "app"
+		_, err := RuncSpec(tt.svc, testImageConfig, tt.opts)
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("expected error %q, got %v", tt.err, err)
+		}
+	}
+}
+
+func TestParseUsernsRemap(t *testing.T) {
+	tests := []struct {
+		value    string
+		mappings []specs.LinuxIDMapping
+		err      string
+	}{
+		{
+			value:    "100000:65536",
+			mappings: []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		},
+		{
+			value: "100000",
+			err:   "Invalid --userns-remap value(100000): must be HOSTID:SIZE",
+		},
+		{
+			value: "100000:65536:1",
+			err:   "Invalid --userns-remap value(100000:65536:1): must be HOSTID:SIZE",
+		},
+		{
+			value: "root:65536",
+			err:   `Invalid --userns-remap host id(root): strconv.ParseUint: parsing "root": invalid syntax`,
+		},
+		{
+			value: "-1:65536",
+			err:   `Invalid --userns-remap host id(-1): strconv.ParseUint: parsing "-1": invalid syntax`,
+		},
+		{
+			value: "100000:lots",
+			err:   "Invalid --userns-remap size(lots)",
+		},
+		{
+			value: "100000:0",
+			err:   "Invalid --userns-remap size(0)",
+		},
+	}
+	for _, tt := range tests {
+		mappings, err := ParseUsernsRemap(tt.value)
+		if len(tt.err) > 0 {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: expected error %q, got %v", tt.value, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.value, err)
+		} else if asJSON(mappings) != asJSON(tt.mappings) {
+			t.Errorf("%s: got %s, expected %s", tt.value, asJSON(mappings), asJSON(tt.mappings))
+		}
+	}
+}
+
+func TestIpcModeErrors(t *testing.T) {
+	for _, svc := range []compose.ServiceConfig{
+		{Name: "app", Ipc: "bogus"},
+		{Name: "app", ShmSize: "lots"},
+		{Name: "app", ShmSize: "0"},
+	} {
+		if _, err := RuncSpec(svc, testImageConfig, SpecOptions{}); err == nil {
+			t.Errorf("expected ipc(%s) shm_size(%s) to be rejected", svc.Ipc, svc.ShmSize)
+		}
+	}
+}
+
+func TestCheckIpcModes(t *testing.T) {
+	tests := []struct {
+		donor string
+		ok    bool
+	}{
+		{"shareable", true},
+		{"host", true},
+		{"", false},
+		{"private", false},
+		{"none", false},
+	}
+	for _, tt := range tests {
+		proj := &compose.Project{Services: compose.Services{
+			{Name: "db", Ipc: tt.donor},
+			{Name: "app", Ipc: "service:db"},
+		}}
+		if err := checkIpcModes(proj); (err == nil) != tt.ok {
+			t.Errorf("joining ipc(%s): got %v", tt.donor, err)
+		}
+	}
+
+	proj := &compose.Project{Services: compose.Services{{Name: "app", Ipc: "service:missing"}}}
+	if err := checkIpcModes(proj); err == nil {
+		t.Error("expected joining a missing service to fail")
+	}
+}
+
+func TestCreateSpecsWritesDefaultSeccomp(t *testing.T) {
+	proj := &compose.Project{Services: compose.Services{{Name: "app", NetworkMode: "host"}}}
+	configs := ServiceConfigs{"app": {testImageConfig}}
+	files, err := CreateSpecs(proj, configs, SpecOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The profile is only filled in when built with the seccomp tag
+	expected, _ := json.MarshalIndent(seccomp.DefaultProfile(), "", "  ")
+	if string(files[".default-secomp.json"]) != string(expected) {
+		t.Errorf("Unexpected .default-secomp.json: %s", files[".default-secomp.json"])
+	}
+	if _, ok := files["app/amd64"]; !ok {
+		t.Errorf("Missing app/amd64 spec: %v", files)
+	}
+}
+
+func TestSetUser(t *testing.T) {
+	passwd := []byte("root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n")
+	group := []byte("root:x:0:\napp:x:1000:\naudio:x:29:app\nvideo:x:44:app\n")
+	tests := []struct {
+		name      string
+		user      string
+		imageUser string
+		noDbs     bool
+		uid       uint32
+		gid       uint32
+		sgids     []uint32
+		err       string
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name:  "user: name",
+			user:  "app",
+			uid:   1000,
+			gid:   1000,
+			sgids: []uint32{29, 44},
+		},
+		{
+			name:      "image user",
+			imageUser: "app",
+			uid:       1000,
+			gid:       1000,
+			sgids:     []uint32{29, 44},
+		},
+		{
+			name:      "service user overrides image user",
+			user:      "root",
+			imageUser: "app",
+		},
+		{
+			name: "uid:gid",
+			user: "1000:29",
+			uid:  1000,
+			gid:  29,
+		},
+		{
+			name: "name:group",
+			user: "app:audio",
+			uid:  1000,
+			gid:  29,
+		},
+		{
+			name: "numeric ids missing from /etc/passwd",
+			user: "2000:3000",
+			uid:  2000,
+			gid:  3000,
+		},
+		{
+			name: "numeric uid missing from /etc/passwd",
+			user: "2000",
+			uid:  2000,
+		},
+		{
+			name:  "numeric ids without /etc/passwd",
+			user:  "2000:3000",
+			noDbs: true,
+			uid:   2000,
+			gid:   3000,
+		},
+		{
+			name: "unknown user",
+			user: "nobody",
+			err:  "Unable to resolve user(nobody): unable to find user nobody: no matching entries in passwd file",
+		},
+		{
+			name: "unknown group",
+			user: "app:nogroup",
+			err:  "Unable to resolve user(app:nogroup): unable to find group nogroup: no matching entries in group file",
+		},
+		{
+			name:  "user: name without /etc/passwd",
+			user:  "app",
+			noDbs: true,
+			err:   "Unable to resolve user(app): unable to find user app: no matching entries in passwd file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := specs.Spec{Process: &specs.Process{}}
+			config := container.Config{User: tt.imageUser}
+			var err error
+			if tt.noDbs {
+				err = setUser(&spec, compose.ServiceConfig{User: tt.user}, config, nil, nil)
+			} else {
+				err = setUser(&spec, compose.ServiceConfig{User: tt.user}, config, passwd, group)
+			}
+			if len(tt.err) > 0 {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			u := spec.Process.User
+			if u.UID != tt.uid || u.GID != tt.gid || asJSON(u.AdditionalGids) != asJSON(tt.sgids) {
+				t.Errorf("got %d:%d %v, expected %d:%d %v", u.UID, u.GID, u.AdditionalGids, tt.uid, tt.gid, tt.sgids)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	compose "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/profiles/seccomp"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Based on parseSecurityOpt from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/daemon_unix.go
+// Docker-compose files commonly use the deprecated "key:value" form, so both
+// separators are accepted.
+func parseSecurityOpts(svc compose.ServiceConfig) (map[string]string, error) {
+	opts := make(map[string]string)
+	for _, opt := range svc.SecurityOpt {
+		if opt == "no-new-privileges" {
+			opts[opt] = "true"
+			continue
+		}
+		var con []string
+		if strings.Contains(opt, "=") {
+			con = strings.SplitN(opt, "=", 2)
+		} else if strings.Contains(opt, ":") {
+			con = strings.SplitN(opt, ":", 2)
+		}
+		if len(con) != 2 {
+			return nil, fmt.Errorf("Invalid security_opt: %q", opt)
+		}
+		switch con[0] {
+		case "seccomp", "no-new-privileges":
+			opts[con[0]] = con[1]
+		default:
+			return nil, fmt.Errorf("Unsupported security_opt: %q", opt)
+		}
+	}
+	return opts, nil
+}
+
+// seccompArch converts our platform names into the architecture names used
+// by the includes/excludes filters of seccomp profiles.
+func seccompArch(platform string) string {
+	switch {
+	case platform == "386":
+		return "x86"
+	case strings.HasPrefix(platform, "arm") && platform != "arm64":
+		return "arm"
+	}
+	return platform
+}
+
+// Based on WithSeccomp and WithNoNewPrivileges from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/daemon/seccomp_linux.go
+// This must be called after the spec's capabilities have been set as the
+// profile's rules get filtered by them. A relative `seccomp=<file>` is read
+// from the project's directory.
+func setSeccomp(spec *specs.Spec, svc compose.ServiceConfig, platform, projectDir string) error {
+	opts, err := parseSecurityOpts(svc)
+	if err != nil {
+		return err
+	}
+
+	if val, ok := opts["no-new-privileges"]; ok {
+		noNewPrivileges, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("Invalid security_opt: no-new-privileges:%s", val)
+		}
+		spec.Process.NoNewPrivileges = noNewPrivileges
+	}
+
+	if svc.Privileged {
+		return nil
+	}
+
+	profile := seccomp.DefaultProfile()
+	path := opts["seccomp"]
+	switch path {
+	case "unconfined":
+		return nil
+	case "":
+		break
+	default:
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(projectDir, path)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Unable to read seccomp profile: %s", err)
+		}
+		profile = &types.Seccomp{}
+		if err := json.Unmarshal(content, profile); err != nil {
+			return fmt.Errorf("Decoding seccomp profile(%s) failed: %v", path, err)
+		}
+	}
+
+	var skipped []string
+	spec.Linux.Seccomp, skipped, err = setupSeccomp(profile, spec, seccompArch(platform))
+	if len(path) > 0 && len(skipped) > 0 {
+		// The default profile only loses ptrace, which newer kernels allow,
+		// so just warn about custom profiles.
+		log.Printf("WARNING: Service(%s): seccomp profile(%s) rules need a minimum kernel version and were left out for: %s",
+			svc.Name, path, strings.Join(skipped, ", "))
+	}
+	return err
+}
+
+var nativeToSeccomp = map[string]types.Arch{
+	"amd64":       types.ArchX86_64,
+	"arm64":       types.ArchAARCH64,
+	"mips64":      types.ArchMIPS64,
+	"mips64n32":   types.ArchMIPS64N32,
+	"mipsel64":    types.ArchMIPSEL64,
+	"mipsel64n32": types.ArchMIPSEL64N32,
+	"s390x":       types.ArchS390X,
+}
+
+// inSlice tests whether a string is contained in a slice of strings or not.
+// Comparison is case sensitive
+func inSlice(slice []string, s string) bool {
+	for _, ss := range slice {
+		if s == ss {
+			return true
+		}
+	}
+	return false
+}
+
+// Based on setupSeccomp from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/profiles/seccomp/seccomp.go
+// Docker filters the profile for the host it's running on. We filter it for
+// the platform the container will run on instead. The target's kernel isn't
+// known at publish time, so rules that need a minimum kernel version are
+// left out. The syscalls of those rules are returned.
+func setupSeccomp(config *types.Seccomp, rs *specs.Spec, arch string) (*specs.LinuxSeccomp, []string, error) {
+	if config == nil {
+		return nil, nil, nil
+	}
+
+	// No default action specified, no syscalls listed, assume seccomp disabled
+	if config.DefaultAction == "" && len(config.Syscalls) == 0 {
+		return nil, nil, nil
+	}
+
+	newConfig := &specs.LinuxSeccomp{}
+	var skipped []string
+
+	if len(config.Architectures) != 0 && len(config.ArchMap) != 0 {
+		return nil, nil, errors.New("'architectures' and 'archMap' were specified in the seccomp profile, use either 'architectures' or 'archMap'")
+	}
+
+	// if config.Architectures == 0 then libseccomp will figure out the architecture to use
+	for _, a := range config.Architectures {
+		newConfig.Architectures = append(newConfig.Architectures, specs.Arch(a))
+	}
+
+	if seccompArch, ok := nativeToSeccomp[arch]; ok {
+		for _, a := range config.ArchMap {
+			if a.Arch == seccompArch {
+				newConfig.Architectures = append(newConfig.Architectures, specs.Arch(a.Arch))
+				for _, sa := range a.SubArches {
+					newConfig.Architectures = append(newConfig.Architectures, specs.Arch(sa))
+				}
+				break
+			}
+		}
+	}
+
+	newConfig.DefaultAction = specs.LinuxSeccompAction(config.DefaultAction)
+
+Loop:
+	// Loop through all syscall blocks and convert them to libcontainer format after filtering them
+	for _, call := range config.Syscalls {
+		if len(call.Excludes.Arches) > 0 {
+			if inSlice(call.Excludes.Arches, arch) {
+				continue Loop
+			}
+		}
+		if len(call.Excludes.Caps) > 0 {
+			for _, c := range call.Excludes.Caps {
+				if inSlice(rs.Process.Capabilities.Bounding, c) {
+					continue Loop
+				}
+			}
+		}
+		if len(call.Includes.Arches) > 0 {
+			if !inSlice(call.Includes.Arches, arch) {
+				continue Loop
+			}
+		}
+		if len(call.Includes.Caps) > 0 {
+			for _, c := range call.Includes.Caps {
+				if !inSlice(rs.Process.Capabilities.Bounding, c) {
+					continue Loop
+				}
+			}
+		}
+		if call.Includes.MinKernel != "" {
+			if call.Name != "" {
+				skipped = append(skipped, call.Name)
+			}
+			skipped = append(skipped, call.Names...)
+			continue Loop
+		}
+
+		if call.Name != "" && len(call.Names) != 0 {
+			return nil, nil, errors.New("'name' and 'names' were specified in the seccomp profile, use either 'name' or 'names'")
+		}
+
+		if call.Name != "" {
+			newConfig.Syscalls = append(newConfig.Syscalls, createSpecsSyscall(call.Name, call.Action, call.Args))
+		}
+
+		for _, n := range call.Names {
+			newConfig.Syscalls = append(newConfig.Syscalls, createSpecsSyscall(n, call.Action, call.Args))
+		}
+	}
+
+	return newConfig, skipped, nil
+}
+
+func createSpecsSyscall(name string, action types.Action, args []*types.Arg) specs.LinuxSyscall {
+	newCall := specs.LinuxSyscall{
+		Names:  []string{name},
+		Action: specs.LinuxSeccompAction(action),
+	}
+
+	// Loop through all the arguments of the syscall and convert them
+	for _, arg := range args {
+		newArg := specs.LinuxSeccompArg{
+			Index:    arg.Index,
+			Value:    arg.Value,
+			ValueTwo: arg.ValueTwo,
+			Op:       specs.LinuxSeccompOperator(arg.Op),
+		}
+
+		newCall.Args = append(newCall.Args, newArg)
+	}
+	return newCall
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	compose "github.com/compose-spec/compose-go/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestSeccompProfileFromProjectDir(t *testing.T) {
+	dir := t.TempDir()
+	profile := `{
+  "defaultAction": "SCMP_ACT_ERRNO",
+  "syscalls": [
+    {"names": ["read", "write"], "action": "SCMP_ACT_ALLOW"},
+    {"names": ["ptrace"], "action": "SCMP_ACT_ALLOW", "includes": {"minKernel": "4.8"}}
+  ]
+}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "profile.json"), []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	proj := &compose.Project{
+		WorkingDir: dir,
+		Services:   compose.Services{{Name: "app", SecurityOpt: []string{"seccomp=profile.json"}}},
+	}
+	specFiles, err := CreateSpecs(proj, ServiceConfigs{"app": {testImageConfig}}, SpecOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec specs.Spec
+	if err := json.Unmarshal(specFiles["app/amd64"], &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, call := range spec.Linux.Seccomp.Syscalls {
+		names = append(names, call.Names...)
+	}
+	if strings.Join(names, ",") != "read,write" {
+		t.Errorf("got syscalls %v, expected read,write", names)
+	}
+	if !strings.Contains(logs.String(), "WARNING: Service(app): seccomp profile("+filepath.Join(dir, "profile.json")+") rules need a minimum kernel version and were left out for: ptrace") {
+		t.Errorf("expected a warning about ptrace, got %q", logs.String())
+	}
+
+	// The default profile doesn't warn about its own rules
+	logs.Reset()
+	proj.Services[0].SecurityOpt = nil
+	if _, err := CreateSpecs(proj, ServiceConfigs{"app": {testImageConfig}}, SpecOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if logs.Len() > 0 {
+		t.Errorf("unexpected warning: %q", logs.String())
+	}
+}
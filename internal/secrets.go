@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	compose "github.com/compose-spec/compose-go/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Default mode of secrets and configs from
+//  https://raw.githubusercontent.com/docker/cli/v20.10.0/cli/compose/convert/service.go
+const defaultFileMountMode = os.FileMode(0444)
+
+// FileMount is a secret or config mounted into a service's container. The
+// file is bind mounted, read-only, from Path in the app's directory.
+type FileMount struct {
+	Name   string      `json:"name"`
+	File   string      `json:"file"`
+	Path   string      `json:"path"`
+	Target string      `json:"target"`
+	UID    int         `json:"uid"`
+	GID    int         `json:"gid"`
+	Mode   os.FileMode `json:"mode"`
+}
+
+// BundleFile is a file added to the bundle with its own ownership and mode.
+type BundleFile struct {
+	Content []byte
+	UID     int
+	GID     int
+	Mode    os.FileMode
+}
+
+// fileMountPath is where a service's secret or config lives in the app's
+// directory. Each service gets its own copy as ownership and mode are per
+// service.
+func fileMountPath(kind, service, name string) string {
+	return path.Join("."+kind, service, name)
+}
+
+// fileMountTarget returns where the file is mounted in the container.
+// Secrets default to /run/secrets/<name> like docker-compose, configs to
+// /<name>.
+func fileMountTarget(kind string, ref compose.FileReferenceConfig) string {
+	target := ref.Target
+	if len(target) == 0 {
+		target = ref.Source
+	}
+	if path.IsAbs(target) {
+		return target
+	}
+	if kind == "secrets" {
+		return path.Join("/run/secrets", target)
+	}
+	return path.Join("/", target)
+}
+
+func fileMount(kind, service string, ref compose.FileReferenceConfig, obj compose.FileObjectConfig) (FileMount, error) {
+	mount := FileMount{
+		Name:   ref.Source,
+		File:   obj.File,
+		Path:   fileMountPath(kind, service, ref.Source),
+		Target: fileMountTarget(kind, ref),
+		Mode:   defaultFileMountMode,
+	}
+	if obj.External.External {
+		return mount, fmt.Errorf("Unsupported external %s: %s", kind, ref.Source)
+	}
+	if len(obj.Driver) > 0 {
+		return mount, fmt.Errorf("Unsupported %s driver: %s", kind, obj.Driver)
+	}
+	if len(obj.File) == 0 {
+		return mount, fmt.Errorf("Missing file for %s: %s", kind, ref.Source)
+	}
+	if len(ref.UID) > 0 {
+		uid, err := strconv.Atoi(ref.UID)
+		if err != nil {
+			return mount, fmt.Errorf("Invalid uid(%s) for %s: %s", ref.UID, ref.Source, err)
+		}
+		mount.UID = uid
+	}
+	if len(ref.GID) > 0 {
+		gid, err := strconv.Atoi(ref.GID)
+		if err != nil {
+			return mount, fmt.Errorf("Invalid gid(%s) for %s: %s", ref.GID, ref.Source, err)
+		}
+		mount.GID = gid
+	}
+	if ref.Mode != nil {
+		mount.Mode = os.FileMode(*ref.Mode)
+	}
+	return mount, nil
+}
+
+func serviceFileMounts(kind, service string, refs []compose.FileReferenceConfig, objs map[string]compose.FileObjectConfig) ([]FileMount, error) {
+	var mounts []FileMount
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		obj, ok := objs[ref.Source]
+		if !ok {
+			return nil, fmt.Errorf("Service(%s): undefined %s: %s", service, kind, ref.Source)
+		}
+		if seen[ref.Source] {
+			return nil, fmt.Errorf("Service(%s): %s %s is used more than once", service, kind, ref.Source)
+		}
+		seen[ref.Source] = true
+		mount, err := fileMount(kind, service, ref, obj)
+		if err != nil {
+			return nil, fmt.Errorf("Service(%s): %s", service, err)
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
+}
+
+func secretMounts(proj *compose.Project, s compose.ServiceConfig) ([]FileMount, error) {
+	objs := make(map[string]compose.FileObjectConfig)
+	for name, obj := range proj.Secrets {
+		objs[name] = compose.FileObjectConfig(obj)
+	}
+	var refs []compose.FileReferenceConfig
+	for _, ref := range s.Secrets {
+		refs = append(refs, compose.FileReferenceConfig(ref))
+	}
+	return serviceFileMounts("secrets", s.Name, refs, objs)
+}
+
+func configMounts(proj *compose.Project, s compose.ServiceConfig) ([]FileMount, error) {
+	objs := make(map[string]compose.FileObjectConfig)
+	for name, obj := range proj.Configs {
+		objs[name] = compose.FileObjectConfig(obj)
+	}
+	var refs []compose.FileReferenceConfig
+	for _, ref := range s.Configs {
+		refs = append(refs, compose.FileReferenceConfig(ref))
+	}
+	return serviceFileMounts("configs", s.Name, refs, objs)
+}
+
+// setFileMounts bind mounts the service's secrets and configs into its
+// container.
+func setFileMounts(spec *specs.Spec, svc compose.ServiceConfig) {
+	add := func(kind, name string, ref compose.FileReferenceConfig) {
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: fileMountTarget(kind, ref),
+			Type:        "bind",
+			Source:      fileMountPath(kind, svc.Name, name),
+			Options:     []string{"rbind", "rprivate", "ro"},
+		})
+	}
+	for _, ref := range svc.Secrets {
+		add("secrets", ref.Source, compose.FileReferenceConfig(ref))
+	}
+	for _, ref := range svc.Configs {
+		add("configs", ref.Source, compose.FileReferenceConfig(ref))
+	}
+}
+
+// ServiceSecrets returns the secrets each service uses. Secrets never go
+// into the bundle. The runner copies each one from File, absolute or
+// relative to the app's directory, to Path with the given ownership and
+// mode.
+func ServiceSecrets(proj *compose.Project) (map[string][]FileMount, error) {
+	secrets := make(map[string][]FileMount)
+	for _, s := range proj.Services {
+		mounts, err := secretMounts(proj, s)
+		if err != nil {
+			return nil, err
+		}
+		if len(mounts) > 0 {
+			secrets[s.Name] = mounts
+		}
+	}
+	return secrets, nil
+}
+
+// ConfigFiles returns the content of each service's configs keyed by where
+// they go in the bundle.
+func ConfigFiles(proj *compose.Project) (map[string]BundleFile, error) {
+	files := make(map[string]BundleFile)
+	for _, s := range proj.Services {
+		mounts, err := configMounts(proj, s)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range mounts {
+			content, err := ioutil.ReadFile(m.File)
+			if err != nil {
+				return nil, fmt.Errorf("Service(%s): Unable to read config %s: %s", s.Name, m.Name, err)
+			}
+			files[m.Path] = BundleFile{Content: content, UID: m.UID, GID: m.GID, Mode: m.Mode}
+		}
+	}
+	return files, nil
+}
+
+// secretFiles returns the files, relative to appDir, holding secrets so they
+// can be kept out of the bundle. Secrets given with an absolute path that's
+// inside appDir are included.
+func secretFiles(appDir string, secrets map[string][]FileMount) ([]string, error) {
+	root, err := filepath.Abs(appDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, mounts := range secrets {
+		for _, m := range mounts {
+			file, err := filepath.Abs(m.File)
+			if err != nil {
+				return nil, err
+			}
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return nil, err
+			}
+			if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				files = append(files, rel)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
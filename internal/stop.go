@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	compose "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/signal"
+)
+
+// Defaults from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/container/container.go
+const (
+	defaultStopSignal  = "SIGTERM"
+	defaultStopTimeout = 10 * time.Second
+)
+
+// StopConfig is how a service's container gets stopped: it's sent Signal
+// and then killed if it hasn't exited after GracePeriod. A negative
+// GracePeriod means wait forever.
+type StopConfig struct {
+	Signal      string
+	GracePeriod time.Duration
+}
+
+// signalName validates a stop signal and returns it in the SIGXXX form
+// systemd understands.
+func signalName(raw string) (string, error) {
+	sig, err := signal.ParseSignal(raw)
+	if err != nil {
+		return "", err
+	}
+	if _, err := strconv.Atoi(raw); err != nil {
+		return "SIG" + strings.TrimPrefix(strings.ToUpper(raw), "SIG"), nil
+	}
+	var names []string
+	for name, val := range signal.SignalMap {
+		if val == sig {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("Invalid signal: %s", raw)
+	}
+	sort.Strings(names)
+	return "SIG" + names[0], nil
+}
+
+// Based on StopSignal and StopTimeout from
+//  https://raw.githubusercontent.com/moby/moby/6458f750e18ad808331e3e6a81c56cc9abe87b91/container/container.go
+// The service's settings take precedence over the image's.
+func stopConfig(svc compose.ServiceConfig, c container.Config) (StopConfig, error) {
+	stop := StopConfig{Signal: defaultStopSignal, GracePeriod: defaultStopTimeout}
+
+	raw := svc.StopSignal
+	if len(raw) == 0 {
+		raw = c.StopSignal
+	}
+	if len(raw) > 0 {
+		name, err := signalName(raw)
+		if err != nil {
+			return stop, err
+		}
+		stop.Signal = name
+	}
+
+	if svc.StopGracePeriod != nil {
+		stop.GracePeriod = time.Duration(*svc.StopGracePeriod)
+	} else if c.StopTimeout != nil {
+		stop.GracePeriod = time.Duration(*c.StopTimeout) * time.Second
+		if *c.StopTimeout < 0 {
+			stop.GracePeriod = -1
+		}
+	}
+	return stop, nil
+}
+
+// StopConfigs returns how each service's container gets stopped. The
+// image's settings are expected to be the same on every platform.
+func StopConfigs(proj *compose.Project, configs ServiceConfigs) (map[string]StopConfig, error) {
+	stops := make(map[string]StopConfig)
+	for _, s := range proj.Services {
+		stop, err := stopConfig(s, container.Config{})
+		if err != nil {
+			return nil, fmt.Errorf("Service(%s): %s", s.Name, err)
+		}
+		for i, cc := range configs[s.Name] {
+			var fullconfig struct {
+				Config container.Config `json:"config"`
+			}
+			if err := json.Unmarshal(cc.Config, &fullconfig); err != nil {
+				return nil, err
+			}
+			platformStop, err := stopConfig(s, fullconfig.Config)
+			if err != nil {
+				return nil, fmt.Errorf("Service(%s): %s", s.Name, err)
+			}
+			if i > 0 && platformStop != stop {
+				return nil, fmt.Errorf("Service(%s) image has a different stop signal or timeout for platform %s", s.Name, cc.Platform)
+			}
+			stop = platformStop
+		}
+		stops[s.Name] = stop
+	}
+	return stops, nil
+}
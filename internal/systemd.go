@@ -2,10 +2,22 @@ package internal
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	compose "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types/container"
 )
 
+// ServiceConditionCompletedSuccessfully is the depends_on condition for
+// waiting on a service to run to completion. compose-go doesn't define it.
+const ServiceConditionCompletedSuccessfully = "service_completed_successfully"
+
+// DependencyRequiredExtension is the depends_on extension holding the
+// dependency's `required` attribute, which compose-go doesn't know about.
+const DependencyRequiredExtension = "x-capp-required"
+
 func systemdRestart(composeRestart string) string {
 	switch composeRestart {
 	case "no":
@@ -23,7 +35,185 @@ func systemdRestart(composeRestart string) string {
 	}
 }
 
-func CreateServices(proj *compose.Project) (map[string][]byte, error) {
+// serviceDependencies returns the services that must be started before this
+// one. This includes services whose namespaces it joins.
+func serviceDependencies(s compose.ServiceConfig) []string {
+	deps := s.GetDependencies()
+	for _, mode := range []string{s.Ipc, s.Pid} {
+		if strings.HasPrefix(mode, "service:") {
+			deps = append(deps, mode[8:])
+		}
+	}
+	sort.Strings(deps)
+	var unique []string
+	for i, dep := range deps {
+		if i == 0 || dep != deps[i-1] {
+			unique = append(unique, dep)
+		}
+	}
+	return unique
+}
+
+// joinsNamespace returns true if the service joins one of dep's namespaces.
+func joinsNamespace(s compose.ServiceConfig, dep string) bool {
+	return s.Ipc == "service:"+dep || s.Pid == "service:"+dep
+}
+
+// CheckDependencies makes sure services only depend on services that exist
+// and that there are no dependency cycles. compose-go's WithServices recurses
+// forever when given a cycle, so this must be done before calling it.
+func CheckDependencies(proj *compose.Project) error {
+	deps := make(map[string][]string)
+	for _, s := range proj.Services {
+		deps[s.Name] = serviceDependencies(s)
+	}
+
+	done := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if done[name] {
+			return nil
+		}
+		for i, p := range path {
+			if p == name {
+				return fmt.Errorf("Dependency cycle: %s", strings.Join(append(path[i:], name), " -> "))
+			}
+		}
+		path = append(path, name)
+		for _, dep := range deps[name] {
+			if _, ok := deps[dep]; !ok {
+				return fmt.Errorf("Service(%s) depends on undefined service: %s", name, dep)
+			}
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		done[name] = true
+		return nil
+	}
+	for _, s := range proj.Services {
+		if err := visit(s.Name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unitDependencies converts a service's dependencies into directives for its
+// unit. Services waited on with service_completed_successfully are given
+// oneshot units, so ordering after them waits for them to exit. Waiting on
+// service_healthy is done by the dependency's "-healthy" unit. Dependencies
+// with `required: false` only get wanted, so the service still starts when
+// they fail. Services whose namespaces get joined are always required.
+func unitDependencies(proj *compose.Project, s compose.ServiceConfig, healthchecks map[string]container.HealthConfig) (string, error) {
+	var lines []string
+	for _, dep := range serviceDependencies(s) {
+		unit := fmt.Sprintf("capp_{{app}}_%s.service", dep)
+		condition := compose.ServiceConditionStarted
+		if d, ok := s.DependsOn[dep]; ok && len(d.Condition) > 0 {
+			condition = d.Condition
+		}
+		switch condition {
+		case compose.ServiceConditionStarted:
+		case compose.ServiceConditionHealthy:
+			if _, ok := healthchecks[dep]; !ok {
+				return "", fmt.Errorf("Service(%s) depends on %s being healthy, but %s has no healthcheck", s.Name, dep, dep)
+			}
+			unit = fmt.Sprintf("capp_{{app}}_%s-healthy.service", dep)
+		case ServiceConditionCompletedSuccessfully:
+			depSvc, err := proj.GetService(dep)
+			if err != nil {
+				return "", err
+			}
+			if systemdRestart(depSvc.Restart) == "always" {
+				return "", fmt.Errorf("Service(%s) waits for %s to complete, but %s always restarts", s.Name, dep, dep)
+			}
+		default:
+			return "", fmt.Errorf("Service(%s) has unsupported depends_on condition for %s: %s", s.Name, dep, condition)
+		}
+		directive := "Requires="
+		if d, ok := s.DependsOn[dep]; ok && d.Extensions[DependencyRequiredExtension] == false && !joinsNamespace(s, dep) {
+			directive = "Wants="
+		}
+		lines = append(lines, directive+unit, "After="+unit)
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// waitedOn returns the services other services wait to complete.
+func waitedOn(proj *compose.Project) map[string]bool {
+	waited := make(map[string]bool)
+	for _, s := range proj.Services {
+		for dep, d := range s.DependsOn {
+			if d.Condition == ServiceConditionCompletedSuccessfully {
+				waited[dep] = true
+			}
+		}
+	}
+	return waited
+}
+
+// systemdTimespan converts a duration into a time span systemd understands.
+func systemdTimespan(d time.Duration) string {
+	return fmt.Sprintf("%dms", d.Milliseconds())
+}
+
+// healthUnits creates the units that run a service's healthcheck:
+//  * A timer and service pair that run a single check every interval. The
+//    runner keeps count of failures and only fails the check once the
+//    service is unhealthy, at which point it is restarted if its restart
+//    policy allows it.
+//  * A oneshot service, for dependents using service_healthy, that waits for
+//    the service to become healthy.
+func healthUnits(services map[string][]byte, s compose.ServiceConfig, hc container.HealthConfig) {
+	restart := ""
+	if systemdRestart(s.Restart) != "no" {
+		restart = fmt.Sprintf("ExecStopPost=/bin/sh -c 'if [ \"$$SERVICE_RESULT\" != \"success\" ] ; then systemctl --no-block restart capp_{{app}}_%s.service ; fi'\n", s.Name)
+	}
+	services[fmt.Sprintf("{{app}}_%s-health.service", s.Name)] = []byte(fmt.Sprintf(`[Unit]
+Description=Compose app service healthcheck
+PartOf=capp_{{app}}_%s.service
+After=capp_{{app}}_%s.service
+
+[Service]
+Type=oneshot
+ExecStart={{binary}} -n {{app}} -d {{appdir}} health %s
+%sSyslogIdentifier={{app}}_%s-health
+`, s.Name, s.Name, s.Name, restart, s.Name))
+
+	services[fmt.Sprintf("{{app}}_%s-health.timer", s.Name)] = []byte(fmt.Sprintf(`[Unit]
+Description=Compose app service healthcheck timer
+PartOf=capp_{{app}}_%s.service
+After=capp_{{app}}_%s.service
+
+[Timer]
+OnActiveSec=%s
+OnUnitActiveSec=%s
+AccuracySec=1ms
+
+[Install]
+WantedBy=capp_{{app}}_%s.service
+`, s.Name, s.Name, systemdTimespan(hc.Interval), systemdTimespan(hc.Interval), s.Name))
+
+	services[fmt.Sprintf("{{app}}_%s-healthy.service", s.Name)] = []byte(fmt.Sprintf(`[Unit]
+Description=Compose app service wait for healthy
+PartOf=capp_{{app}}_%s.service
+Requires=capp_{{app}}_%s.service
+After=capp_{{app}}_%s.service
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+TimeoutStartSec=infinity
+ExecStart={{binary}} -n {{app}} -d {{appdir}} health --wait %s
+SyslogIdentifier={{app}}_%s-healthy
+`, s.Name, s.Name, s.Name, s.Name, s.Name))
+}
+
+func CreateServices(proj *compose.Project, healthchecks map[string]container.HealthConfig, stops map[string]StopConfig) (map[string][]byte, error) {
 	services := make(map[string][]byte)
 	services["{{app}}.service"] = []byte(`[Unit]
 Description=Compose app
@@ -41,18 +231,41 @@ WantedBy=multi-user.target
 Description=Compose app service
 PartOf=capp_{{app}}.service
 After=capp_{{app}}.service
-
+%s
 [Service]
-ExecStart={{binary}} -n {{app}} -d {{appdir}} up %s
+%sExecStart={{binary}} -n {{app}} -d {{appdir}} up %s
 SyslogIdentifier={{app}}_%s
 Restart=%s
+KillSignal=%s
+TimeoutStopSec=%s
 
 [Install]
 WantedBy=capp_{{app}}.service
 `
+	waited := waitedOn(proj)
 	return services, proj.WithServices(nil, func(s compose.ServiceConfig) error {
+		deps, err := unitDependencies(proj, s, healthchecks)
+		if err != nil {
+			return err
+		}
+		serviceType := ""
+		if waited[s.Name] {
+			serviceType = "Type=oneshot\nRemainAfterExit=yes\n"
+		}
+		stop := stops[s.Name]
+		timeoutStop := "infinity"
+		if stop.GracePeriod >= time.Millisecond {
+			timeoutStop = systemdTimespan(stop.GracePeriod)
+		} else if stop.GracePeriod >= 0 {
+			// systemd takes a timeout of 0 to mean wait forever, whereas
+			// docker kills the container straight away.
+			timeoutStop = "1ms"
+		}
 		fname := fmt.Sprintf("{{app}}_%s.service", s.Name)
-		services[fname] = []byte(fmt.Sprintf(svcFmt, s.Name, s.Name, systemdRestart(s.Restart)))
+		services[fname] = []byte(fmt.Sprintf(svcFmt, deps, serviceType, s.Name, s.Name, systemdRestart(s.Restart), stop.Signal, timeoutStop))
+		if hc, ok := healthchecks[s.Name]; ok {
+			healthUnits(services, s, hc)
+		}
 		return nil
 	})
 }
@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	compose "github.com/compose-spec/compose-go/types"
+)
+
+func durationp(d time.Duration) *compose.Duration {
+	cd := compose.Duration(d)
+	return &cd
+}
+
+func TestStopTimeouts(t *testing.T) {
+	tests := []struct {
+		name        string
+		gracePeriod *compose.Duration
+		image       string
+		expected    string
+	}{
+		{
+			name:     "unset",
+			image:    `{}`,
+			expected: "TimeoutStopSec=10000ms",
+		},
+		{
+			name:        "stop_grace_period",
+			gracePeriod: durationp(90 * time.Second),
+			image:       `{"StopTimeout":30}`,
+			expected:    "TimeoutStopSec=90000ms",
+		},
+		{
+			name:        "stop_grace_period of 0 kills at once",
+			gracePeriod: durationp(0),
+			image:       `{}`,
+			expected:    "TimeoutStopSec=1ms",
+		},
+		{
+			name:     "image StopTimeout",
+			image:    `{"StopTimeout":30}`,
+			expected: "TimeoutStopSec=30000ms",
+		},
+		{
+			name:     "image StopTimeout of 0",
+			image:    `{"StopTimeout":0}`,
+			expected: "TimeoutStopSec=1ms",
+		},
+		{
+			name:     "negative image StopTimeout waits forever",
+			image:    `{"StopTimeout":-1}`,
+			expected: "TimeoutStopSec=infinity",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proj := &compose.Project{Services: compose.Services{
+				{Name: "app", StopGracePeriod: tt.gracePeriod},
+			}}
+			configs := ServiceConfigs{"app": {{
+				Platform: "amd64",
+				Config:   []byte(`{"architecture":"amd64","os":"linux","config":` + tt.image + `}`),
+			}}}
+			stops, err := StopConfigs(proj, configs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			units, err := CreateServices(proj, nil, stops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			unit := string(units["{{app}}_app.service"])
+			if !strings.Contains(unit, "\n"+tt.expected+"\n") {
+				t.Errorf("expected %s in:\n%s", tt.expected, unit)
+			}
+		})
+	}
+}
+
+func TestCheckDependencies(t *testing.T) {
+	dependsOn := func(deps ...string) compose.DependsOnConfig {
+		config := make(compose.DependsOnConfig)
+		for _, dep := range deps {
+			config[dep] = compose.ServiceDependency{Condition: compose.ServiceConditionStarted}
+		}
+		return config
+	}
+	tests := []struct {
+		name     string
+		services compose.Services
+		err      string
+	}{
+		{
+			name: "no cycle",
+			services: compose.Services{
+				{Name: "a", DependsOn: dependsOn("b", "c")},
+				{Name: "b", DependsOn: dependsOn("c")},
+				{Name: "c"},
+			},
+		},
+		{
+			name:     "self dependency",
+			services: compose.Services{{Name: "a", DependsOn: dependsOn("a")}},
+			err:      "Dependency cycle: a -> a",
+		},
+		{
+			name: "direct cycle",
+			services: compose.Services{
+				{Name: "a", DependsOn: dependsOn("b")},
+				{Name: "b", DependsOn: dependsOn("a")},
+			},
+			err: "Dependency cycle: a -> b -> a",
+		},
+		{
+			name: "indirect cycle",
+			services: compose.Services{
+				{Name: "a", DependsOn: dependsOn("b")},
+				{Name: "b", DependsOn: dependsOn("c")},
+				{Name: "c", DependsOn: dependsOn("a")},
+			},
+			err: "Dependency cycle: a -> b -> c -> a",
+		},
+		{
+			name: "cycle through a namespace",
+			services: compose.Services{
+				{Name: "a", Ipc: "service:b"},
+				{Name: "b", DependsOn: dependsOn("a")},
+			},
+			err: "Dependency cycle: a -> b -> a",
+		},
+		{
+			name:     "undefined service",
+			services: compose.Services{{Name: "a", DependsOn: dependsOn("b")}},
+			err:      "Service(a) depends on undefined service: b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckDependencies(&compose.Project{Services: tt.services})
+			if len(tt.err) == 0 && err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.err) > 0 && (err == nil || err.Error() != tt.err) {
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestUnitDependencies(t *testing.T) {
+	notRequired := map[string]interface{}{DependencyRequiredExtension: false}
+	tests := []struct {
+		name string
+		svc  compose.ServiceConfig
+		db   compose.ServiceConfig
+		unit string
+		err  string
+	}{
+		{
+			name: "none",
+		},
+		{
+			name: "service_started",
+			svc: compose.ServiceConfig{DependsOn: compose.DependsOnConfig{
+				"db": {Condition: compose.ServiceConditionStarted},
+			}},
+			unit: "Requires=capp_{{app}}_db.service\nAfter=capp_{{app}}_db.service\n",
+		},
+		{
+			name: "service_started not required",
+			svc: compose.ServiceConfig{DependsOn: compose.DependsOnConfig{
+				"db": {Condition: compose.ServiceConditionStarted, Extensions: notRequired},
+			}},
+			unit: "Wants=capp_{{app}}_db.service\nAfter=capp_{{app}}_db.service\n",
+		},
+		{
+			name: "service_healthy",
+			svc: compose.ServiceConfig{DependsOn: compose.DependsOnConfig{
+				"db": {Condition: compose.ServiceConditionHealthy},
+			}},
+			db:   compose.ServiceConfig{HealthCheck: &compose.HealthCheckConfig{Test: compose.HealthCheckTest{"CMD", "true"}}},
+			unit: "Requires=capp_{{app}}_db-healthy.service\nAfter=capp_{{app}}_db-healthy.service\n",
+		},
+		{
+			name: "service_healthy not required",
+			svc: compose.ServiceConfig{DependsOn: compose.DependsOnConfig{
+				"db": {Condition: compose.ServiceConditionHealthy, Extensions: notRequired},
+			}},
+			db:   compose.ServiceConfig{HealthCheck: &compose.HealthCheckConfig{Test: compose.HealthCheckTest{"CMD", "true"}}},
+			unit: "Wants=capp_{{app}}_db-healthy.service\nAfter=capp_{{app}}_db-healthy.service\n",
+		},
+		{
+			name: "service_healthy without a healthcheck",
+			svc: compose.ServiceConfig{DependsOn: compose.DependsOnConfig{
+				"db": {Condition: compose.ServiceConditionHealthy},
+			}},
+			err: "Service(app) depends on db being healthy, but db has no healthcheck",
+		},
+		{
+			name: "service_completed_successfully",
+			svc: compose.ServiceConfig{DependsOn: compose.DependsOnConfig{
+				"db": {Condition: ServiceConditionCompletedSuccessfully},
+			}},
+			unit: "Requires=capp_{{app}}_db.service\nAfter=capp_{{app}}_db.service\n",
+		},
+		{
+			name: "service_completed_successfully always restarting",
+			svc: compose.ServiceConfig{DependsOn: compose.DependsOnConfig{
+				"db": {Condition: ServiceConditionCompletedSuccessfully},
+			}},
+			db:  compose.ServiceConfig{Restart: "always"},
+			err: "Service(app) waits for db to complete, but db always restarts",
+		},
+		{
+			name: "unsupported condition",
+			svc: compose.ServiceConfig{DependsOn: compose.DependsOnConfig{
+				"db": {Condition: "service_ready"},
+			}},
+			err: "Service(app) has unsupported depends_on condition for db: service_ready",
+		},
+		{
+			name: "joined namespace always required",
+			svc: compose.ServiceConfig{Ipc: "service:db", DependsOn: compose.DependsOnConfig{
+				"db": {Condition: compose.ServiceConditionStarted, Extensions: notRequired},
+			}},
+			db:   compose.ServiceConfig{Ipc: "shareable"},
+			unit: "Requires=capp_{{app}}_db.service\nAfter=capp_{{app}}_db.service\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.svc.Name = "app"
+			tt.db.Name = "db"
+			proj := &compose.Project{Services: compose.Services{tt.svc, tt.db}}
+			configs := ServiceConfigs{"app": {testImageConfig}, "db": {testImageConfig}}
+			hcs, err := Healthchecks(proj, configs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stops, err := StopConfigs(proj, configs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			units, err := CreateServices(proj, hcs, stops)
+			if len(tt.err) > 0 {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := "After=capp_{{app}}.service\n" + tt.unit + "\n[Service]"
+			if unit := string(units["{{app}}_app.service"]); !strings.Contains(unit, expected) {
+				t.Errorf("expected:\n%s\nin:\n%s", expected, unit)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+
+	compose "github.com/compose-spec/compose-go/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Volume is a volume the runner manages as a directory on the host.
+type Volume struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver,omitempty"`
+	DriverOpts map[string]string `json:"driver_opts,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	External   bool              `json:"external,omitempty"`
+	// Service is set for anonymous volumes, which belong to a single service
+	Service string `json:"service,omitempty"`
+}
+
+// volumeSource is the source of a volume's bind mount. The host directory
+// isn't known until the app is installed, so it's a placeholder the runner
+// replaces with the volume's directory.
+func volumeSource(name string) string {
+	return fmt.Sprintf("{{volume:%s}}", name)
+}
+
+// anonymousVolume names the volume created for a service's mount that isn't
+// backed by a named volume. Docker gives these random names, but the name
+// has to be the same every time the app is published.
+func anonymousVolume(service, target string) string {
+	return fmt.Sprintf("%s_%s", service, digest.FromString(path.Clean(target)).Encoded()[:12])
+}
+
+// serviceMountTargets returns where the service's volumes and tmpfs mounts
+// go. These take the place of the image's VOLUMEs.
+func serviceMountTargets(svc compose.ServiceConfig) map[string]bool {
+	targets := make(map[string]bool)
+	for _, v := range svc.Volumes {
+		targets[path.Clean(v.Target)] = true
+	}
+	for _, tfs := range svc.Tmpfs {
+		targets[path.Clean(tfs)] = true
+	}
+	return targets
+}
+
+// imageVolumes returns the VOLUMEs of the image the service doesn't mount
+// anything over.
+func imageVolumes(svc compose.ServiceConfig, c container.Config) []string {
+	targets := serviceMountTargets(svc)
+	var volumes []string
+	for target := range c.Volumes {
+		if !targets[path.Clean(target)] {
+			volumes = append(volumes, path.Clean(target))
+		}
+	}
+	sort.Strings(volumes)
+	return volumes
+}
+
+// setImageVolumes mounts an anonymous volume at each of the image's
+// VOLUMEs like Docker does.
+func setImageVolumes(spec *specs.Spec, svc compose.ServiceConfig, c container.Config) {
+	for _, target := range imageVolumes(svc, c) {
+		spec.Mounts = append(spec.Mounts, specs.Mount{
+			Destination: target,
+			Type:        "bind",
+			Source:      volumeSource(anonymousVolume(svc.Name, target)),
+			Options:     []string{"rbind", "rprivate", "rw"},
+		})
+	}
+}
+
+// Volumes returns the volumes the runner has to create for the app keyed
+// by the name used in their mount's placeholder.
+func Volumes(proj *compose.Project, configs ServiceConfigs) (map[string]Volume, error) {
+	volumes := make(map[string]Volume)
+	for key, v := range proj.Volumes {
+		if len(v.Driver) > 0 && v.Driver != "local" {
+			return nil, fmt.Errorf("Volume(%s): Unsupported driver: %s", key, v.Driver)
+		}
+		name := v.Name
+		if len(name) == 0 {
+			name = key
+		}
+		volumes[key] = Volume{
+			Name:       name,
+			Driver:     v.Driver,
+			DriverOpts: v.DriverOpts,
+			Labels:     v.Labels,
+			External:   v.External.External,
+		}
+	}
+
+	for _, s := range proj.Services {
+		for _, v := range s.Volumes {
+			if v.Type != "volume" {
+				continue
+			}
+			if len(v.Source) == 0 {
+				name := anonymousVolume(s.Name, v.Target)
+				volumes[name] = Volume{Name: name, Service: s.Name}
+			} else if _, ok := volumes[v.Source]; !ok {
+				return nil, fmt.Errorf("Service(%s) refers to undefined volume %s", s.Name, v.Source)
+			}
+		}
+		for _, cc := range configs[s.Name] {
+			var fullconfig struct {
+				Config container.Config `json:"config"`
+			}
+			if err := json.Unmarshal(cc.Config, &fullconfig); err != nil {
+				return nil, err
+			}
+			for _, target := range imageVolumes(s, fullconfig.Config) {
+				name := anonymousVolume(s.Name, target)
+				volumes[name] = Volume{Name: name, Service: s.Name}
+			}
+		}
+	}
+	return volumes, nil
+}
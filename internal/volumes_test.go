@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/compose-spec/compose-go/loader"
+	compose "github.com/compose-spec/compose-go/types"
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestAnonymousVolume(t *testing.T) {
+	// The names end up in the specs and on the device so they must never
+	// change between publishes.
+	if name := anonymousVolume("db", "/var/lib/db"); name != "db_b90499f2a0ee" {
+		t.Errorf("got %s, expected db_b90499f2a0ee", name)
+	}
+	if anonymousVolume("db", "/data/") != anonymousVolume("db", "/data") {
+		t.Error("expected the target to be cleaned")
+	}
+	if anonymousVolume("db", "/data") == anonymousVolume("db", "/cache") {
+		t.Error("expected each target to get its own volume")
+	}
+	if anonymousVolume("db", "/data") == anonymousVolume("web", "/data") {
+		t.Error("expected each service to get its own volume")
+	}
+}
+
+func TestVolumes(t *testing.T) {
+	config, err := loader.ParseYAML([]byte(`
+services:
+  db:
+    image: postgres
+    volumes:
+      - data:/data
+      - /cache
+      - type: volume
+        target: /logs
+      - ./conf:/conf:ro
+  web:
+    image: nginx
+    volumes:
+      - data:/srv:ro
+      - shared:/shared
+volumes:
+  data:
+  shared:
+    external: true
+    name: app-shared
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proj, err := loader.Load(compose.ConfigDetails{
+		WorkingDir:  "/app",
+		ConfigFiles: []compose.ConfigFile{{Filename: "docker-compose.yml", Config: config}},
+		Environment: map[string]string{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := ContainerConfig{
+		Platform: "amd64",
+		Config:   []byte(`{"architecture":"amd64","os":"linux","config":{"Volumes":{"/var/lib/db":{},"/data":{}}}}`),
+	}
+	configs := ServiceConfigs{"db": {image}, "web": {testImageConfig}}
+
+	volumes, err := Volumes(proj, configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Volume{
+		"data":            {Name: "data"},
+		"shared":          {Name: "app-shared", External: true},
+		"db_4f7cfe6fcd42": {Name: "db_4f7cfe6fcd42", Service: "db"},
+		"db_b90499f2a0ee": {Name: "db_b90499f2a0ee", Service: "db"},
+		"db_c06682b718ac": {Name: "db_c06682b718ac", Service: "db"},
+	}
+	if asJSON(volumes) != asJSON(expected) {
+		t.Errorf("got %s, expected %s", asJSON(volumes), asJSON(expected))
+	}
+	again, err := Volumes(proj, configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if asJSON(again) != asJSON(volumes) {
+		t.Errorf("volumes changed between runs: %s != %s", asJSON(again), asJSON(volumes))
+	}
+
+	mounts := func(svc string, cc ContainerConfig) map[string]string {
+		s, err := proj.GetService(svc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := RuncSpec(s, cc, SpecOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var spec specs.Spec
+		if err := json.Unmarshal(content, &spec); err != nil {
+			t.Fatal(err)
+		}
+		sources := make(map[string]string)
+		for _, m := range spec.Mounts {
+			if m.Type == "bind" {
+				sources[m.Destination] = m.Source
+			}
+		}
+		return sources
+	}
+	tests := []struct {
+		svc     string
+		image   ContainerConfig
+		sources map[string]string
+	}{
+		{
+			svc:   "db",
+			image: image,
+			sources: map[string]string{
+				"/data":       "{{volume:data}}",
+				"/cache":      "{{volume:db_4f7cfe6fcd42}}",
+				"/logs":       "{{volume:db_c06682b718ac}}",
+				"/conf":       "/app/conf",
+				"/var/lib/db": "{{volume:db_b90499f2a0ee}}",
+			},
+		},
+		{
+			svc:   "web",
+			image: testImageConfig,
+			sources: map[string]string{
+				"/srv":    "{{volume:data}}",
+				"/shared": "{{volume:shared}}",
+			},
+		},
+	}
+	for _, tt := range tests {
+		sources := mounts(tt.svc, tt.image)
+		for dst, src := range tt.sources {
+			if sources[dst] != src {
+				t.Errorf("%s: %s mounted from %q, expected %q", tt.svc, dst, sources[dst], src)
+			}
+		}
+		for _, src := range sources {
+			if src == "{{volume:db_bd47413b5c03}}" {
+				t.Errorf("%s: image VOLUME /data mounted over the service's volume", tt.svc)
+			}
+		}
+	}
+}
+
+func TestVolumesErrors(t *testing.T) {
+	tests := []struct {
+		proj *compose.Project
+		err  string
+	}{
+		{
+			proj: &compose.Project{Services: compose.Services{{
+				Name:    "app",
+				Volumes: []compose.ServiceVolumeConfig{{Type: "volume", Source: "missing", Target: "/data"}},
+			}}},
+			err: "Service(app) refers to undefined volume missing",
+		},
+		{
+			proj: &compose.Project{Volumes: compose.Volumes{"data": {Driver: "nfs"}}},
+			err:  "Volume(data): Unsupported driver: nfs",
+		},
+	}
+	for _, tt := range tests {
+		_, err := Volumes(tt.proj, ServiceConfigs{})
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("expected error %q, got %v", tt.err, err)
+		}
+	}
+}
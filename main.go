@@ -1,14 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/compose-spec/compose-go/envfile"
 	"github.com/compose-spec/compose-go/loader"
 	compose "github.com/compose-spec/compose-go/types"
 	commandLine "github.com/urfave/cli/v2"
@@ -23,22 +29,26 @@ const banner = `
 `
 
 func main() {
-	var file string
 	var digestFile string
 	var dryRun bool
 	var ostreeRepo string
+	var ociLayout string
+	var warnPlatforms bool
+	var usernsRemap string
+	var initPath string
+	var envFile string
+	var recordEnv bool
+	var asJSON bool
 
-	fmt.Print(banner)
 	app := &commandLine.App{
 		Name:  "compose-ref",
 		Usage: "Reference Compose Specification implementation",
 		Flags: []commandLine.Flag{
-			&commandLine.StringFlag{
-				Name:        "file",
-				Aliases:     []string{"f"},
-				Value:       "docker-compose.yml",
-				Usage:       "Load Compose file `FILE`",
-				Destination: &file,
+			&commandLine.StringSliceFlag{
+				Name:    "file",
+				Aliases: []string{"f"},
+				Value:   commandLine.NewStringSlice("docker-compose.yml"),
+				Usage:   "Load Compose file `FILE`. Repeat to merge later files over earlier ones",
 			},
 			&commandLine.StringFlag{
 				Name:        "digest-file",
@@ -59,13 +69,118 @@ func main() {
 				Usage:       "Save container images into ostree repo",
 				Destination: &ostreeRepo,
 			},
+			&commandLine.StringFlag{
+				Name:        "oci-layout",
+				Required:    false,
+				Usage:       "Pin images from, and publish the app to, the OCI image layout in `DIR` rather than a registry",
+				Destination: &ociLayout,
+			},
+			&commandLine.StringFlag{
+				Name:  "registry-config",
+				Usage: "Read registry credentials from the docker config.json `FILE` rather than ~/.docker/config.json",
+			},
+			&commandLine.StringSliceFlag{
+				Name:  "insecure-registry",
+				Usage: "Don't verify the certificate of, and allow plain http to, registry `HOST[:PORT]` or CIDR. Can be repeated",
+			},
+			&commandLine.StringFlag{
+				Name:  "registry-certs-dir",
+				Usage: "Read each registry's CA (*.crt) and client certificates (*.cert, *.key) from `DIR`/HOST[:PORT] like /etc/docker/certs.d",
+			},
+			&commandLine.StringFlag{
+				Name:  "registry-ca",
+				Usage: "Trust the CA certificates in `FILE` for every registry",
+			},
+			&commandLine.StringFlag{
+				Name:  "registry-cert",
+				Usage: "Present the client certificate in `FILE` to every registry",
+			},
+			&commandLine.StringFlag{
+				Name:  "registry-key",
+				Usage: "Key, in `FILE`, of the --registry-cert client certificate",
+			},
+			&commandLine.IntFlag{
+				Name:  "registry-attempts",
+				Value: internal.DefaultRegistryAttempts,
+				Usage: "Try registry requests failing with a 5xx, 429 or dropped connection up to `N` times",
+			},
+			&commandLine.BoolFlag{
+				Name:        "warn-platforms",
+				Required:    false,
+				Usage:       "Only warn, rather than fail, when services have no platform in common",
+				Destination: &warnPlatforms,
+			},
+			&commandLine.StringFlag{
+				Name:        "env-file",
+				Required:    false,
+				Usage:       "Read variables for interpolation from `FILE` rather than .env",
+				Destination: &envFile,
+			},
+			&commandLine.BoolFlag{
+				Name:        "record-env",
+				Required:    false,
+				Usage:       "Record the values of the variables interpolated into the compose file in the bundle",
+				Destination: &recordEnv,
+			},
+			&commandLine.StringFlag{
+				Name:        "userns-remap",
+				Required:    false,
+				Usage:       "Run containers in a user namespace with root mapped to host ids `HOSTID:SIZE`",
+				Destination: &usernsRemap,
+			},
+			&commandLine.StringFlag{
+				Name:        "init-path",
+				Required:    false,
+				Value:       internal.DefaultInitPath,
+				Usage:       "Host `PATH` of the init binary the runner provides for services with 'init: true'",
+				Destination: &initPath,
+			},
+		},
+		Commands: []*commandLine.Command{
+			{
+				Name:      "inspect",
+				Usage:     "Show the content of a published app",
+				ArgsUsage: "REF",
+				Flags: []commandLine.Flag{
+					&commandLine.BoolFlag{
+						Name:        "json",
+						Required:    false,
+						Usage:       "Print the app as JSON",
+						Destination: &asJSON,
+					},
+				},
+				Action: func(c *commandLine.Context) error {
+					ref := c.Args().Get(0)
+					if len(ref) == 0 {
+						return errors.New("Missing required argument: REF")
+					}
+					store, err := internal.NewImageStore(ociLayout, registryOptions(c))
+					if err != nil {
+						return err
+					}
+					return doInspect(store, ref, asJSON)
+				},
+			},
 		},
 		Action: func(c *commandLine.Context) error {
+			fmt.Print(banner)
 			target := c.Args().Get(0)
 			if len(target) == 0 {
 				return errors.New("Missing required argument: TARGET:[TAG]")
 			}
-			return doPublish(file, target, digestFile, ostreeRepo, dryRun)
+			opts, err := specOptions(usernsRemap, initPath)
+			if err != nil {
+				return err
+			}
+			env, err := projectEnv(c.StringSlice("file"), envFile)
+			if err != nil {
+				return err
+			}
+			store, err := internal.NewImageStore(ociLayout, registryOptions(c))
+			if err != nil {
+				return err
+			}
+			return doPublish(store, c.StringSlice("file"), env, target, digestFile, ostreeRepo, dryRun, warnPlatforms, recordEnv, opts)
 		},
 	}
 
@@ -75,42 +190,250 @@ func main() {
 	}
 }
 
-func loadProj(file string, config map[string]interface{}) (*compose.Project, error) {
+// registryOptions returns how to connect to registries from the command line.
+func registryOptions(c *commandLine.Context) internal.RegistryOptions {
+	return internal.RegistryOptions{
+		InsecureRegistries: c.StringSlice("insecure-registry"),
+		CertsDir:           c.String("registry-certs-dir"),
+		CACert:             c.String("registry-ca"),
+		ClientCert:         c.String("registry-cert"),
+		ClientKey:          c.String("registry-key"),
+		ConfigFile:         c.String("registry-config"),
+		Attempts:           c.Int("registry-attempts"),
+	}
+}
+
+// loadConfig reads the compose files and merges them into one config.
+func loadConfig(files []string) (map[string]interface{}, error) {
+	var configs []map[string]interface{}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		config, err := loader.ParseYAML(b)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse %s: %s", file, err)
+		}
+		configs = append(configs, config)
+	}
+	return internal.MergeConfigs(configs...), nil
+}
+
+// projectEnv returns the variables available for interpolation. As with
+// docker-compose, variables set in the shell take precedence over the ones
+// in the env file. That is the .env next to the first compose file unless
+// envFile is given.
+func projectEnv(files []string, envFile string) (map[string]string, error) {
 	env := make(map[string]string)
+
+	path := envFile
+	if len(path) == 0 {
+		path = filepath.Join(filepath.Dir(files[0]), ".env")
+	}
+	if _, err := os.Stat(path); err == nil || len(envFile) > 0 {
+		vars, err := envfile.Parse(path)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read env file: %s", err)
+		}
+		for key, val := range vars {
+			if val != nil {
+				env[key] = *val
+			}
+		}
+	}
+
 	for _, val := range os.Environ() {
-		parts := strings.Split(val, "=")
-		env[parts[0]] = parts[1]
+		parts := strings.SplitN(val, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		}
+	}
+	return env, nil
+}
+
+// loadProj loads the compose project. Relative paths in it are resolved
+// against the directory of the compose file, as docker-compose does. It
+// returns the project along with the variables that were interpolated into it.
+func loadProj(file string, config map[string]interface{}, env map[string]string) (*compose.Project, map[string]string, error) {
+	used := make(map[string]string)
+	recordLookups := func(opts *loader.Options) {
+		lookup := opts.Interpolate.LookupValue
+		opts.Interpolate.LookupValue = func(key string) (string, bool) {
+			val, ok := lookup(key)
+			if ok {
+				used[key] = val
+			}
+			return val, ok
+		}
 	}
 
 	var files []compose.ConfigFile
-	files = append(files, compose.ConfigFile{Filename: file, Config: config})
-	return loader.Load(compose.ConfigDetails{
-		WorkingDir:  ".",
+	files = append(files, compose.ConfigFile{Filename: file, Config: hideDependsOnConditions(config)})
+	proj, err := loader.Load(compose.ConfigDetails{
+		WorkingDir:  filepath.Dir(file),
 		ConfigFiles: files,
 		Environment: env,
-	})
+	}, recordLookups)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := setDependsOnConditions(proj, config); err != nil {
+		return nil, nil, err
+	}
+	if err := setPidsLimits(proj, config); err != nil {
+		return nil, nil, err
+	}
+	return proj, used, setMemSwappiness(proj, config)
 }
 
-func doPublish(file, target, digestFile, ostreeRepo string, dryRun bool) error {
-	b, err := ioutil.ReadFile(file)
-	if err != nil {
-		return err
+// The compose-go schema predates the `service_completed_successfully`
+// depends_on condition and the `required` attribute and rejects them. Give
+// the loader a copy of the config with the condition replaced by
+// `service_started` and without `required`. setDependsOnConditions puts
+// them back.
+func hideDependsOnConditions(config map[string]interface{}) map[string]interface{} {
+	services, _ := config["services"].(map[string]interface{})
+	copied := make(map[string]interface{})
+	for name, val := range services {
+		svc, _ := val.(map[string]interface{})
+		dependsOn, _ := svc["depends_on"].(map[string]interface{})
+		if dependsOn == nil {
+			copied[name] = val
+			continue
+		}
+		newDependsOn := make(map[string]interface{})
+		for dep, depVal := range dependsOn {
+			depConfig, _ := depVal.(map[string]interface{})
+			_, hasRequired := depConfig["required"]
+			if hasRequired || depConfig["condition"] == internal.ServiceConditionCompletedSuccessfully {
+				newDepConfig := make(map[string]interface{})
+				for k, v := range depConfig {
+					newDepConfig[k] = v
+				}
+				if depConfig["condition"] == internal.ServiceConditionCompletedSuccessfully {
+					newDepConfig["condition"] = compose.ServiceConditionStarted
+				}
+				delete(newDepConfig, "required")
+				depVal = newDepConfig
+			}
+			newDependsOn[dep] = depVal
+		}
+		newSvc := make(map[string]interface{})
+		for k, v := range svc {
+			newSvc[k] = v
+		}
+		newSvc["depends_on"] = newDependsOn
+		copied[name] = newSvc
+	}
+
+	newConfig := make(map[string]interface{})
+	for k, v := range config {
+		newConfig[k] = v
+	}
+	if services != nil {
+		newConfig["services"] = copied
+	}
+	return newConfig
+}
+
+func setDependsOnConditions(proj *compose.Project, config map[string]interface{}) error {
+	services, _ := config["services"].(map[string]interface{})
+	for _, s := range proj.Services {
+		svc, _ := services[s.Name].(map[string]interface{})
+		dependsOn, _ := svc["depends_on"].(map[string]interface{})
+		for dep, depVal := range dependsOn {
+			depConfig, _ := depVal.(map[string]interface{})
+			d := s.DependsOn[dep]
+			if depConfig["condition"] == internal.ServiceConditionCompletedSuccessfully {
+				d.Condition = internal.ServiceConditionCompletedSuccessfully
+			}
+			if val, ok := depConfig["required"]; ok {
+				required, err := strconv.ParseBool(fmt.Sprint(val))
+				if err != nil {
+					return fmt.Errorf("Service(%s) has invalid depends_on 'required' for %s: %v", s.Name, dep, val)
+				}
+				if d.Extensions == nil {
+					d.Extensions = make(map[string]interface{})
+				}
+				d.Extensions[internal.DependencyRequiredExtension] = required
+			}
+			s.DependsOn[dep] = d
+		}
+	}
+	return nil
+}
+
+// compose-go decodes `pid_limit` into ServiceConfig.PidLimit rather than the
+// `pids_limit` attribute the compose spec defines, so pull it in ourselves.
+func setPidsLimits(proj *compose.Project, config map[string]interface{}) error {
+	services, _ := config["services"].(map[string]interface{})
+	for i, s := range proj.Services {
+		svc, _ := services[s.Name].(map[string]interface{})
+		val, ok := svc["pids_limit"]
+		if !ok {
+			continue
+		}
+		limit, err := strconv.ParseInt(fmt.Sprint(val), 10, 64)
+		if err != nil {
+			return fmt.Errorf("Service(%s) has invalid 'pids_limit': %v", s.Name, val)
+		}
+		proj.Services[i].PidLimit = limit
+	}
+	return nil
+}
+
+// compose-go can't tell `mem_swappiness: 0` from it being unset. Record the
+// value given so RuncSpec can tell the two apart.
+func setMemSwappiness(proj *compose.Project, config map[string]interface{}) error {
+	services, _ := config["services"].(map[string]interface{})
+	for i, s := range proj.Services {
+		svc, _ := services[s.Name].(map[string]interface{})
+		val, ok := svc["mem_swappiness"]
+		if !ok {
+			continue
+		}
+		swappiness, err := strconv.ParseInt(fmt.Sprint(val), 10, 64)
+		if err != nil {
+			return fmt.Errorf("Service(%s) has invalid 'mem_swappiness': %v", s.Name, val)
+		}
+		if proj.Services[i].Extensions == nil {
+			proj.Services[i].Extensions = make(map[string]interface{})
+		}
+		proj.Services[i].Extensions[internal.MemSwappinessExtension] = swappiness
+	}
+	return nil
+}
+
+func specOptions(usernsRemap, initPath string) (internal.SpecOptions, error) {
+	opts := internal.SpecOptions{InitPath: initPath}
+	if !filepath.IsAbs(initPath) {
+		return opts, fmt.Errorf("Invalid --init-path(%s): must be an absolute path", initPath)
+	}
+	if len(usernsRemap) > 0 {
+		mappings, err := internal.ParseUsernsRemap(usernsRemap)
+		if err != nil {
+			return opts, err
+		}
+		opts.UsernsRemap = mappings
 	}
-	config, err := loader.ParseYAML(b)
+	return opts, nil
+}
+
+func doPublish(store internal.ImageStore, files []string, env map[string]string, target, digestFile, ostreeRepo string, dryRun, warnPlatforms, recordEnv bool, opts internal.SpecOptions) error {
+	config, err := loadConfig(files)
 	if err != nil {
 		return err
 	}
 
 	ctx := context.Background()
 
-	proj, err := loadProj(file, config)
+	proj, variables, err := loadProj(files[0], config, env)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("= Creating systemd units...")
-	unitFiles, err := internal.CreateServices(proj)
-	if err != nil {
+	if err := internal.CheckDependencies(proj); err != nil {
 		return err
 	}
 
@@ -119,27 +442,73 @@ func doPublish(file, target, digestFile, ostreeRepo string, dryRun bool) error {
 	if !ok {
 		return errors.New("Unable to find 'services' section of compose file")
 	}
-	configs, err := internal.PinServiceImages(ctx, svcs.(map[string]interface{}), proj)
+	configs, platforms, err := internal.PinServiceImages(ctx, store, svcs.(map[string]interface{}), proj, warnPlatforms)
 	if err != nil {
 		return err
 	}
 
 	var ostreeShas map[string][]byte
 	if len(ostreeRepo) > 0 {
-		ostreeShas, err = internal.OstreeCommit(ctx, ostreeRepo, proj, configs)
+		ostreeShas, err = internal.OstreeCommit(ctx, store, ostreeRepo, proj, configs)
 		if err != nil {
 			return err
 		}
 	}
 
 	fmt.Println("= Creating runc specs...")
-	specFiles, err := internal.CreateSpecs(proj, configs)
+	specFiles, err := internal.CreateSpecs(proj, configs, opts)
+	if err != nil {
+		return err
+	}
+
+	devices, err := internal.HostDevices(proj)
+	if err != nil {
+		return err
+	}
+
+	healthchecks, err := internal.Healthchecks(proj, configs)
+	if err != nil {
+		return err
+	}
+
+	stops, err := internal.StopConfigs(proj, configs)
+	if err != nil {
+		return err
+	}
+
+	volumes, err := internal.Volumes(proj, configs)
+	if err != nil {
+		return err
+	}
+
+	secrets, err := internal.ServiceSecrets(proj)
+	if err != nil {
+		return err
+	}
+	configFiles, err := internal.ConfigFiles(proj)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("= Creating systemd units...")
+	unitFiles, err := internal.CreateServices(proj, healthchecks, stops)
 	if err != nil {
 		return err
 	}
 
 	fmt.Println("= Publishing app...")
-	dgst, err := internal.CreateApp(ctx, config, target, ostreeShas, specFiles, unitFiles, dryRun)
+	info := internal.BundleInfo{
+		Platforms:    platforms,
+		Devices:      devices,
+		Healthchecks: healthchecks,
+		Init:         internal.InitBinary(proj, opts),
+		Volumes:      volumes,
+		Secrets:      secrets,
+	}
+	if recordEnv {
+		info.Variables = variables
+	}
+	dgst, err := internal.CreateApp(ctx, store, config, target, info, ostreeShas, specFiles, unitFiles, configFiles, dryRun)
 	if err != nil {
 		return err
 	}
@@ -148,3 +517,67 @@ func doPublish(file, target, digestFile, ostreeRepo string, dryRun bool) error {
 	}
 	return nil
 }
+
+func doInspect(store internal.ImageStore, ref string, asJSON bool) error {
+	app, err := internal.InspectApp(context.Background(), store, ref)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		buf, err := json.MarshalIndent(app, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+		return nil
+	}
+
+	fmt.Print(banner)
+	fmt.Println("= Manifest:", app.Manifest)
+	fmt.Println("= Bundle:", app.Bundle)
+	fmt.Println("= Platforms:", strings.Join(app.Info.Platforms, ", "))
+	if len(app.Info.Init) > 0 {
+		fmt.Println("= Init:", app.Info.Init)
+	}
+
+	var names []string
+	for name := range app.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println("= Services:")
+	for _, name := range names {
+		svc := app.Services[name]
+		fmt.Printf("  %s(%s)\n", name, svc.Image)
+		fmt.Println("  |-> platforms:", strings.Join(svc.Platforms, ", "))
+	}
+
+	fmt.Println("= Runc specs:")
+	for _, spec := range app.Specs {
+		fmt.Println("  ", spec)
+	}
+	fmt.Println("= Systemd units:")
+	for _, unit := range app.Units {
+		fmt.Println("  ", unit)
+	}
+	if len(app.OstreeShas) > 0 {
+		var imgs []string
+		for img := range app.OstreeShas {
+			imgs = append(imgs, img)
+		}
+		sort.Strings(imgs)
+		fmt.Println("= Ostree hashes:")
+		for _, img := range imgs {
+			fmt.Printf("  %s: %s\n", img, app.OstreeShas[img])
+		}
+	}
+
+	var compose bytes.Buffer
+	if err := json.Indent(&compose, app.Compose, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println("= Pinned compose:")
+	fmt.Println(compose.String())
+	return nil
+}